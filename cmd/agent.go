@@ -1,11 +1,18 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sighupio/furyagent/pkg/agent"
 	"github.com/sighupio/furyagent/pkg/component"
 	"github.com/sighupio/furyagent/pkg/storage"
 
+	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
@@ -13,6 +20,7 @@ import (
 type AgentConfig struct {
 	Storage          storage.Config          `yml:"storage"`
 	ClusterComponent component.ClusterConfig `yml:"clusterComponent"`
+	Agent            agent.Config            `yml:"agent"`
 }
 
 // InitAgent reads the configuration file
@@ -31,5 +39,69 @@ func InitAgent(configFile string) (*AgentConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to decode into struct, %v", err)
 	}
+	if err := conf.Agent.Validate(); err != nil {
+		return nil, err
+	}
 	return conf, nil
 }
+
+// agentCmd represents the `furyagent agent` command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Runs furyagent as a daemon",
+	Long:  ``,
+}
+
+// agentRunCmd represents the `furyagent agent run` command
+var agentRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Takes the etcd backups and reconciles the ssh keys and the OpenVPN CRL periodically",
+	Long: `Takes the etcd backups every etcd.backupFrequency, runs configure ssh-keys every
+agent.sshKeysFrequency and downloads the OpenVPN CRL every agent.crlFrequency, until SIGTERM or SIGINT.
+The last run of every task is kept in agent.stateFile, so a restart does not run them again too early.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		tasks := agentTasks(agentConfig)
+		if len(tasks) == 0 {
+			fatal(fmt.Errorf("no task to schedule, set etcd.backupFrequency, agent.sshKeysFrequency or agent.crlFrequency"))
+		}
+		stateFile := agentConfig.Agent.StateFile
+		if stateFile == "" {
+			stateFile = agent.DefaultStateFile
+		}
+		daemon := &agent.Agent{Tasks: tasks, StatePath: stateFile, Jitter: agentConfig.Agent.Jitter}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-signals
+			log.Printf("received %v, waiting for the running tasks to complete", sig)
+			cancel()
+		}()
+		if err := daemon.Run(ctx); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// agentTasks returns the tasks enabled in conf
+func agentTasks(conf *AgentConfig) []agent.Task {
+	var tasks []agent.Task
+	if freq := conf.ClusterComponent.Etcd.BackupFrequency; freq > 0 {
+		tasks = append(tasks, agent.Task{Name: "etcd-backup", Interval: freq, Run: component.Etcd{data}.Backup})
+	}
+	if freq := conf.Agent.SSHKeysFrequency; freq > 0 {
+		tasks = append(tasks, agent.Task{Name: "ssh-keys", Interval: freq, Run: func() error {
+			return component.SSHComponent{data}.Configure(true)
+		}})
+	}
+	if freq := conf.Agent.CRLFrequency; freq > 0 {
+		tasks = append(tasks, agent.Task{Name: "openvpn-crl", Interval: freq, Run: component.OpenVPN{data}.SyncCRL})
+	}
+	return tasks
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+	agentCmd.AddCommand(agentRunCmd)
+}
@@ -1,12 +1,18 @@
 package cmd
 
 import (
-	"log"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
 
+	"github.com/olekukonko/tablewriter"
 	"github.com/sighupio/furyagent/pkg/component"
 	"github.com/spf13/cobra"
 )
 
+var backupListNode string
+
 // backupCmd represents the `furyctl backup` command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
@@ -24,12 +30,50 @@ var etcdBackupCmd = &cobra.Command{
 		var etcd component.ClusterComponent = component.Etcd{data}
 		err := etcd.Backup()
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
+		}
+	},
+}
+
+// backupListCmd represents the `furyagent backup list` command
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the stored backups",
+	Long:  ``,
+}
+
+// etcdBackupListCmd represents the `furyagent backup list etcd` command
+var etcdBackupListCmd = &cobra.Command{
+	Use:   "etcd",
+	Short: "Lists the etcd snapshots of every node, newest first",
+	Long:  `Lists the etcd snapshots of every node, newest first. The snapshot column is the id accepted by restore etcd --snapshot.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		found, err := component.Etcd{data}.ListSnapshots(backupListNode)
+		if err != nil {
+			fatal(err)
+		}
+		if len(found) == 0 {
+			fmt.Println("no etcd snapshots found")
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetAutoWrapText(false)
+		table.SetHeader([]string{"Node", "Time", "Size", "Revision", "Snapshot"})
+		for _, s := range found {
+			revision := "-"
+			if s.Status != nil {
+				revision = strconv.FormatInt(s.Status.Revision, 10)
+			}
+			table.Append([]string{s.Node, s.Time.UTC().Format(time.RFC3339), strconv.FormatInt(s.Size, 10), revision, s.Key})
 		}
+		table.Render()
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
 	backupCmd.AddCommand(etcdBackupCmd)
+	backupCmd.AddCommand(backupListCmd)
+	backupListCmd.AddCommand(etcdBackupListCmd)
+	etcdBackupListCmd.Flags().StringVar(&backupListNode, "node", "", "lists the snapshots of this node only")
 }
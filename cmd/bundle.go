@@ -0,0 +1,124 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sighupio/furyagent/pkg/component"
+	"github.com/sighupio/furyagent/pkg/planner"
+	"github.com/sighupio/furyagent/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bundlePassphraseFile string
+	bundleEtcd           bool
+	bundleOverwrite      bool
+)
+
+// bundleCmd represents the `furyagent bundle` command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Exports and imports the cluster PKI in an encrypted archive",
+	Long: `Packs the objects under pki/, ssh/ and join/ (and optionally the last etcd snapshots) in a single
+archive encrypted with a passphrase, for an offline escrow of the cluster CAs or to move a cluster
+to another storage. The passphrase is read from --passphrase-file or FURYAGENT_BUNDLE_PASSPHRASE.`,
+}
+
+// bundleExportCmd represents the `furyagent bundle export` command
+var bundleExportCmd = &cobra.Command{
+	Use:   "export <file>",
+	Short: "Writes the PKI of the bucket to an encrypted bundle",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase := bundlePassphrase()
+		var snapshots []string
+		if bundleEtcd {
+			var err error
+			if snapshots, err = (component.Etcd{data}).LatestSnapshots(); err != nil {
+				fatal(err)
+			}
+		}
+		prefixes := storage.BundlePrefixes
+		err := planner.Do(fmt.Sprintf("export %s and %d etcd objects to %s", strings.Join(prefixes, ", "), len(snapshots), args[0]), func() error {
+			f, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			manifest, err := store.ExportBundle(f, passphrase, prefixes, snapshots...)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(args[0])
+				return err
+			}
+			fmt.Printf("%d objects exported to %s\n", len(manifest.Files), args[0])
+			return nil
+		})
+		if err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// bundleImportCmd represents the `furyagent bundle import` command
+var bundleImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Uploads the content of a bundle to the bucket",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase := bundlePassphrase()
+		f, err := os.Open(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		manifest, err := store.ImportBundle(f, passphrase, bundleOverwrite)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%d objects imported from %s, exported by %s on %s\n", len(manifest.Files), args[0], manifest.Hostname, manifest.Created.Format("2006-01-02 15:04:05 MST"))
+	},
+}
+
+// bundlePassphrase reads the passphrase of the bundle from --passphrase-file or FURYAGENT_BUNDLE_PASSPHRASE
+func bundlePassphrase() string {
+	if bundlePassphraseFile != "" {
+		content, err := ioutil.ReadFile(bundlePassphraseFile)
+		if err != nil {
+			fatal(err)
+		}
+		return strings.TrimRight(string(content), "\r\n")
+	}
+	if passphrase := os.Getenv("FURYAGENT_BUNDLE_PASSPHRASE"); passphrase != "" {
+		return passphrase
+	}
+	fatal(errors.New("the passphrase of the bundle must be set with --passphrase-file or FURYAGENT_BUNDLE_PASSPHRASE"))
+	return ""
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleExportCmd, bundleImportCmd)
+	bundleCmd.PersistentFlags().StringVar(&bundlePassphraseFile, "passphrase-file", "", "file holding the passphrase of the bundle")
+	bundleExportCmd.Flags().BoolVar(&bundleEtcd, "etcd", false, "exports the last etcd snapshot of every node too")
+	bundleImportCmd.Flags().BoolVar(&bundleOverwrite, "overwrite", false, "replaces the objects already in the bucket")
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// clustersCmd represents the `furyagent clusters` command
+var clustersCmd = &cobra.Command{
+	Use:   "clusters",
+	Short: "Manages the clusters sharing the bucket",
+	Long:  ``,
+}
+
+// clustersListCmd represents the `furyagent clusters list` command
+var clustersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the clusters stored in the bucket",
+	Long:  `Lists the clusters stored in the bucket, each one can be selected with storage.clusterName`,
+	Run: func(cmd *cobra.Command, args []string) {
+		clusters, err := store.Clusters()
+		if err != nil {
+			fatal(err)
+		}
+		for _, cluster := range clusters {
+			if cluster == "" {
+				fmt.Println("(bucket root, no clusterName)")
+				continue
+			}
+			fmt.Println(cluster)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(clustersCmd)
+	clustersCmd.AddCommand(clustersListCmd)
+}
@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"errors"
-	"log"
 
 	"github.com/sighupio/furyagent/pkg/component"
 	"github.com/spf13/cobra"
@@ -31,7 +30,7 @@ var etcdConfigCmd = &cobra.Command{
 		var etcd component.ClusterComponent = component.Etcd{data}
 		err := etcd.Configure(overwrite)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -45,7 +44,7 @@ var masterConfigCmd = &cobra.Command{
 		var master component.ClusterComponent = component.Master{component.ClusterComponentData{&agentConfig.ClusterComponent, store}}
 		err := master.Configure(overwrite)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -59,7 +58,7 @@ var NodeConfigureCmd = &cobra.Command{
 		var node component.ClusterComponent = component.Node{data}
 		err := node.Configure(overwrite)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -73,7 +72,7 @@ var openVPNConfigCmd = &cobra.Command{
 		var openvpn component.ClusterComponent = component.OpenVPN{data}
 		err := openvpn.Configure(overwrite)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -88,7 +87,7 @@ var openVPNClientConfigCmd = &cobra.Command{
 		var openvpnClient component.OpenVPNClient = component.OpenVPNClient{data}
 
 		if len(openvpnClient.ClusterComponentData.ClusterConfig.OpenVPN.Servers) == 0 {
-			log.Fatal(errors.New("`openvpnClient.ClusterComponentData.ClusterConfig.OpenVPN.Servers` must not be empty (and must be a list)"))
+			fatal(errors.New("`openvpnClient.ClusterComponentData.ClusterConfig.OpenVPN.Servers` must not be empty (and must be a list)"))
 		}
 
 		if revoke {
@@ -99,7 +98,7 @@ var openVPNClientConfigCmd = &cobra.Command{
 			err = openvpnClient.CreateUser(clientName)
 		}
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -113,7 +112,7 @@ var SSHKeysConfigCmd = &cobra.Command{
 		var ssh component.ClusterComponent = component.SSHComponent{data}
 		err := ssh.Configure(overwrite)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
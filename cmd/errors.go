@@ -0,0 +1,54 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"github.com/sighupio/furyagent/pkg/storage"
+)
+
+// Exit codes of furyagent, one for each class of error
+const (
+	exitError         = 1
+	exitNotFound      = 2
+	exitAlreadyExists = 3
+	exitPermission    = 4
+	exitConflict      = 5
+)
+
+// exitCode returns the exit code of the class of err
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return exitNotFound
+	case errors.Is(err, storage.ErrAlreadyExists), errors.Is(err, os.ErrExist):
+		return exitAlreadyExists
+	case errors.Is(err, storage.ErrPermission):
+		return exitPermission
+	case errors.Is(err, storage.ErrConflict):
+		return exitConflict
+	default:
+		return exitError
+	}
+}
+
+// fatal logs err and exits with the exit code of its class
+func fatal(err error) {
+	log.Print(err)
+	os.Exit(exitCode(err))
+}
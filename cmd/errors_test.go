@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/sighupio/furyagent/pkg/storage"
+)
+
+func TestExitCode(t *testing.T) {
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	_, initErr := storage.Init(&storage.Config{Provider: "s3", URL: forbidden.URL, BucketName: "furyagent", AccessKey: "key", SecretKey: "secret"})
+
+	for name, c := range map[string]struct {
+		err      error
+		expected int
+	}{
+		"403 at init":       {initErr, exitPermission},
+		"conflicted update": {fmt.Errorf("Cannot update pki/vpn/ca.crl: %w", storage.ErrConflict), exitConflict},
+		"missing object":    {fmt.Errorf("Cannot read version 2 of pki/vpn/ca.crl: %w", storage.ErrNotFound), exitNotFound},
+		"existing object":   {fmt.Errorf("pki/vpn/ca.crt %w", storage.ErrAlreadyExists), exitAlreadyExists},
+		"missing file":      {&os.PathError{Op: "open", Path: "furyagent.yml", Err: os.ErrNotExist}, exitNotFound},
+		"other":             {fmt.Errorf("boom"), exitError},
+	} {
+		if code := exitCode(c.err); code != c.expected {
+			t.Errorf("%s: exit code %d, expected %d (%v)", name, code, c.expected, c.err)
+		}
+	}
+}
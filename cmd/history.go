@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var rollbackVersion int
+
+// historyCmd represents the `furyagent history` command
+var historyCmd = &cobra.Command{
+	Use:   "history <path>",
+	Short: "Lists the previous versions of an object in the bucket",
+	Long:  `Lists the previous versions of an object under pki/, oldest first`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		versions, err := store.History(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		if len(versions) == 0 {
+			fmt.Printf("no previous versions of %s\n", args[0])
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Version", "Timestamp", "Operation", "Uploader", "Hostname", "Size"})
+		for _, v := range versions {
+			table.Append([]string{
+				strconv.Itoa(v.Number),
+				v.Timestamp.Format(time.RFC3339),
+				v.Operation,
+				v.Uploader,
+				v.Hostname,
+				strconv.FormatInt(v.Size, 10),
+			})
+		}
+		table.Render()
+	},
+}
+
+// rollbackCmd represents the `furyagent rollback` command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <path>",
+	Short: "Restores a previous version of an object in the bucket",
+	Long:  `Restores a previous version of an object under pki/, the current version is kept in the history`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := store.Rollback(args[0], rollbackVersion)
+		if err != nil {
+			fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rollbackCmd.Flags().IntVar(&rollbackVersion, "version", 0, "the version to restore, as listed by `furyagent history`")
+	rollbackCmd.MarkFlagRequired("version")
+}
@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"log"
-
 	"github.com/sighupio/furyagent/pkg/component"
 	"github.com/spf13/cobra"
 )
@@ -24,7 +22,7 @@ var etcdInitCmd = &cobra.Command{
 		var etcd component.ClusterComponent = component.Etcd{data}
 		err := etcd.Init(initDir)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -37,7 +35,7 @@ var masterInitCmd = &cobra.Command{
 		var master component.ClusterComponent = component.Master{data}
 		err := master.Init(initDir)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -50,7 +48,7 @@ var openVpnInitCmd = &cobra.Command{
 		var openvpn component.ClusterComponent = component.OpenVPN{data}
 		err := openvpn.Init(initDir)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -63,7 +61,7 @@ var sshKeysInitCmd = &cobra.Command{
 		var ssh component.ClusterComponent = component.SSHComponent{data}
 		err := ssh.Init(initDir)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
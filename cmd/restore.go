@@ -1,12 +1,19 @@
 package cmd
 
 import (
-	"log"
+	"fmt"
+	"time"
 
 	"github.com/sighupio/furyagent/pkg/component"
 	"github.com/spf13/cobra"
 )
 
+var (
+	restoreSnapshot string
+	restoreBefore   string
+	restoreFromNode string
+)
+
 // restoreCmd represents the `furyctl restore` subcommand
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
@@ -18,12 +25,23 @@ var restoreCmd = &cobra.Command{
 var etcdRestoreCmd = &cobra.Command{
 	Use:   "etcd",
 	Short: "Restores etcd node",
-	Long:  `Restores etcd node`,
+	Long: `Restores etcd node from the latest snapshot, or from the one selected by --snapshot, --before or --from-node.
+Run it on every member of an HA cluster with the same flags.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		var etcd component.ClusterComponent = component.Etcd{data}
-		err := etcd.Restore()
+		opts := component.EtcdRestoreOptions{Snapshot: restoreSnapshot, FromNode: restoreFromNode}
+		if restoreSnapshot != "" && (restoreBefore != "" || restoreFromNode != "") {
+			fatal(fmt.Errorf("--snapshot cannot be used with --before or --from-node"))
+		}
+		if restoreBefore != "" {
+			before, err := time.Parse(time.RFC3339, restoreBefore)
+			if err != nil {
+				fatal(fmt.Errorf("invalid --before, expected a RFC 3339 timestamp like 2020-03-18T12:00:00Z: %v", err))
+			}
+			opts.Before = before
+		}
+		err := component.Etcd{data}.RestoreSnapshot(opts)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	},
 }
@@ -31,4 +49,7 @@ var etcdRestoreCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(restoreCmd)
 	restoreCmd.AddCommand(etcdRestoreCmd)
+	etcdRestoreCmd.Flags().StringVar(&restoreSnapshot, "snapshot", "", "restores this snapshot, as listed by backup list etcd")
+	etcdRestoreCmd.Flags().StringVar(&restoreBefore, "before", "", "restores the last snapshot taken before this RFC 3339 timestamp")
+	etcdRestoreCmd.Flags().StringVar(&restoreFromNode, "from-node", "", "restores a snapshot of this node instead of the first etcd member")
 }
@@ -21,13 +21,16 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/sighupio/furyagent/pkg/component"
+	"github.com/sighupio/furyagent/pkg/planner"
 	"github.com/sighupio/furyagent/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
 var cfgFile string
+var noCache bool
 var store *storage.Data
 var agentConfig *AgentConfig
 var (
@@ -48,18 +51,31 @@ func getConfig(cfgFile string) (*AgentConfig, *storage.Data) {
 	// Reads the configuration file
 	agentConfig, err := InitAgent(cfgFile)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	agentConfig.Storage.Cache.Disabled = agentConfig.Storage.Cache.Disabled || noCache
 	// Initializes the storage
 	store, err := storage.Init(&agentConfig.Storage)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	return agentConfig, store
 }
 
+// setProvenance records the node and the command in the metadata of the objects uploaded to store
+func setProvenance(store *storage.Data, agentConfig *AgentConfig, cmd *cobra.Command, args []string) {
+	store.SetProvenance(storage.Provenance{
+		NodeName: agentConfig.ClusterComponent.NodeName,
+		Version:  version,
+		Commit:   commit,
+		Command:  strings.TrimSpace(cmd.CommandPath() + " " + strings.Join(args, " ")),
+	})
+}
+
 func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "furyagent.yml", "config file path")
+	rootCmd.PersistentFlags().BoolVar(&planner.Default.DryRun, "dry-run", false, "prints the changes to the bucket, the files and the commands instead of performing them")
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "downloads every object from the bucket, ignoring the local cache")
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(printParsedConfig)
 }
@@ -75,6 +91,7 @@ var rootCmd = &cobra.Command{
 			return
 		}
 		agentConfig, store = getConfig(cfgFile)
+		setProvenance(store, agentConfig, cmd, args)
 		data = component.ClusterComponentData{&agentConfig.ClusterComponent, store}
 	},
 }
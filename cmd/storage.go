@@ -0,0 +1,424 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/sighupio/furyagent/pkg/planner"
+	"github.com/sighupio/furyagent/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	storageRecursive bool
+	storageForce     bool
+	storageYes       bool
+	storageLong      bool
+	migrateFrom      string
+	migrateTo        string
+	migrateOptions   storage.MigrateOptions
+	cacheMaxAge      time.Duration
+)
+
+// storageCmd represents the `furyagent storage` command
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Inspects and manipulates the bucket",
+	Long:  `Inspects and manipulates the bucket configured in furyagent.yml, whatever its provider`,
+}
+
+// storageLsCmd represents the `furyagent storage ls` command
+var storageLsCmd = &cobra.Command{
+	Use:   "ls [path]",
+	Short: "Lists the objects in the bucket with their size",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := store.Browse(argOrEmpty(args), storageRecursive)
+		if err != nil {
+			fatal(err)
+		}
+		if !storageLong {
+			for _, e := range entries {
+				fmt.Printf("%12d  %s  %s\n", e.Size, e.LastModified.UTC().Format(time.RFC3339), e.Name)
+			}
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		header := []string{"Size", "Modified", "Name"}
+		for _, key := range storage.ProvenanceKeys {
+			header = append(header, strings.Title(key))
+		}
+		table.SetAutoWrapText(false)
+		table.SetHeader(header)
+		for _, e := range entries {
+			row := []string{strconv.FormatInt(e.Size, 10), e.LastModified.UTC().Format(time.RFC3339), e.Name}
+			for _, key := range storage.ProvenanceKeys {
+				row = append(row, storage.DecodeMetadata(e.Metadata[key]))
+			}
+			table.Append(row)
+		}
+		table.Render()
+	},
+}
+
+// storageGetCmd represents the `furyagent storage get` command
+var storageGetCmd = &cobra.Command{
+	Use:   "get <path> [local path]",
+	Short: "Downloads an object, to stdout if the local path is -",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		localPath := path.Base(args[0])
+		if len(args) == 2 {
+			localPath = args[1]
+		}
+		if localPath == "-" {
+			if err := store.Download(args[0], os.Stdout); err != nil {
+				fatal(err)
+			}
+			return
+		}
+		if _, err := os.Stat(localPath); err == nil && !storageForce {
+			fatal(fmt.Errorf("%s %w, use --force to overwrite it", localPath, storage.ErrAlreadyExists))
+		}
+		if err := downloadFile(args[0], localPath); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// downloadFile downloads name next to localPath and renames it in place only once complete,
+// so a failed download leaves the existing file untouched
+func downloadFile(name, localPath string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := store.Download(name, tmpFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), localPath)
+}
+
+// storagePutCmd represents the `furyagent storage put` command
+var storagePutCmd = &cobra.Command{
+	Use:   "put <local path> <path>",
+	Short: "Uploads a local file to the bucket",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dest := args[1]
+		if strings.HasSuffix(dest, "/") {
+			dest += path.Base(args[0])
+		}
+		upload := store.UploadFile
+		if storageForce {
+			upload = store.UploadFileForce
+		}
+		if err := upload(dest, args[0]); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// storageRmCmd represents the `furyagent storage rm` command
+var storageRmCmd = &cobra.Command{
+	Use:   "rm <path>",
+	Short: "Removes an object, or a directory with --recursive, from the bucket",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		names := []string{args[0]}
+		if storageRecursive {
+			entries, err := store.Browse(args[0], true)
+			if err != nil {
+				fatal(err)
+			}
+			names = names[:0]
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+		} else if !store.Exists(args[0]) {
+			fatal(fmt.Errorf("%s %w", args[0], storage.ErrNotFound))
+		}
+		if len(names) == 0 {
+			fatal(fmt.Errorf("nothing found under %s: %w", args[0], storage.ErrNotFound))
+		}
+		question := fmt.Sprintf("Remove %s?", args[0])
+		if storageRecursive {
+			question = fmt.Sprintf("Remove %d objects below %s?", len(names), args[0])
+		}
+		if !storageYes && !confirm(question) {
+			return
+		}
+		for _, name := range names {
+			if err := store.Remove(name); err != nil {
+				fatal(err)
+			}
+			// in dry-run mode the planner already printed the delete
+			if !planner.DryRun() {
+				fmt.Printf("removed %s\n", name)
+			}
+		}
+	},
+}
+
+// storageCpCmd represents the `furyagent storage cp` command
+var storageCpCmd = &cobra.Command{
+	Use:   "cp <path> <destination>",
+	Short: "Copies an object inside the bucket",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := store.Copy(args[0], destination(args[0], args[1])); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// storageMvCmd represents the `furyagent storage mv` command
+var storageMvCmd = &cobra.Command{
+	Use:   "mv <path> <destination>",
+	Short: "Moves an object inside the bucket",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dest := destination(args[0], args[1])
+		var err error
+		if path.Base(dest) == path.Base(args[0]) {
+			err = store.Move(path.Base(args[0]), path.Dir(args[0]), path.Dir(dest))
+		} else if err = store.Copy(args[0], dest); err == nil {
+			err = store.Remove(args[0])
+		}
+		if err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// storageTreeCmd represents the `furyagent storage tree` command
+var storageTreeCmd = &cobra.Command{
+	Use:   "tree [path]",
+	Short: "Prints the layout of the bucket",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		prefix := argOrEmpty(args)
+		entries, err := store.Browse(prefix, true)
+		if err != nil {
+			fatal(err)
+		}
+		root := &treeNode{children: map[string]*treeNode{}}
+		for _, e := range entries {
+			root.add(strings.Split(strings.TrimPrefix(e.Name, strings.TrimSuffix(prefix, "/")+"/"), "/"))
+		}
+		if prefix == "" {
+			fmt.Println(agentConfig.Storage.Provider + " bucket")
+		} else {
+			fmt.Println(prefix)
+		}
+		root.print("")
+	},
+}
+
+// storageMigrateCmd represents the `furyagent storage migrate` command
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copies every object from a bucket to another one",
+	Long: `Copies every object of the storage configured in --from to the one configured in --to,
+verifying the checksum of each copy. Objects already migrated are skipped, so an interrupted
+migration can be run again.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		return
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		_, src := getConfig(migrateFrom)
+		defer src.Close()
+		dstConfig, dst := getConfig(migrateTo)
+		defer dst.Close()
+		setProvenance(dst, dstConfig, cmd, args)
+		report, err := storage.Migrate(src, dst, migrateOptions)
+		if err != nil {
+			fatal(err)
+		}
+		action := "copied"
+		if report.DryRun {
+			action = "to copy"
+		}
+		fmt.Printf("%d objects %s (%d bytes), %d skipped (%d already migrated, %d identical), %d failed\n",
+			len(report.Copied), action, report.Bytes, len(report.Skipped), report.Resumed, report.Identical, len(report.Failed))
+		var failed []string
+		for name := range report.Failed {
+			failed = append(failed, name)
+		}
+		sort.Strings(failed)
+		for _, name := range failed {
+			fmt.Printf("FAILED %s: %v\n", name, report.Failed[name])
+		}
+		if len(failed) > 0 {
+			os.Exit(exitError)
+		}
+	},
+}
+
+// storageCheckCmd represents the `furyagent storage check` command
+var storageCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Tests the write, read, list and delete permissions on the bucket",
+	Long: `Writes a probe object under .furyagent-check/, reads it back comparing the bytes, lists the
+directory and deletes the probe, reporting the outcome and the latency of each step.
+Exits with a non-zero code if any capability is missing. With --dry-run the write and the
+delete are only reported as planned and only the list is tested.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var failure error
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Capability", "Result", "Latency", "Error"})
+		for _, step := range store.Check() {
+			result, message := "PASS", ""
+			if step.Planned {
+				result = "PLANNED"
+			} else if step.Skipped() {
+				result, message = "SKIPPED", step.Err.Error()
+			} else if !step.Passed() {
+				result, message = "FAIL", step.Err.Error()
+				if failure == nil {
+					failure = step.Err
+				}
+			}
+			table.Append([]string{step.Name, result, step.Latency.Round(time.Millisecond).String(), message})
+		}
+		table.Render()
+		if failure != nil {
+			os.Exit(exitCode(failure))
+		}
+	},
+}
+
+// storageCacheCmd represents the `furyagent storage cache` command
+var storageCacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manages the local cache of the downloaded objects",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		var err error
+		if agentConfig, err = InitAgent(cfgFile); err != nil {
+			fatal(err)
+		}
+	},
+}
+
+// storageCachePruneCmd represents the `furyagent storage cache prune` command
+var storageCachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes the cached objects not used recently",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := agentConfig.Storage.Cache.Dir
+		if dir == "" {
+			var err error
+			if dir, err = storage.DefaultCacheDir(); err != nil {
+				fatal(err)
+			}
+		}
+		removed, freed, err := storage.PruneCache(dir, cacheMaxAge)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%d cached objects removed from %s (%d bytes)\n", removed, dir, freed)
+	},
+}
+
+type treeNode struct {
+	children map[string]*treeNode
+}
+
+func (t *treeNode) add(parts []string) {
+	if len(parts) == 0 || parts[0] == "" {
+		return
+	}
+	child, ok := t.children[parts[0]]
+	if !ok {
+		child = &treeNode{children: map[string]*treeNode{}}
+		t.children[parts[0]] = child
+	}
+	child.add(parts[1:])
+}
+
+func (t *treeNode) print(indent string) {
+	var names []string
+	for name := range t.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		branch, next := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Println(indent + branch + name)
+		t.children[name].print(indent + next)
+	}
+}
+
+func argOrEmpty(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// destination appends the name of src to dest when dest is a directory
+func destination(src, dest string) string {
+	if strings.HasSuffix(dest, "/") {
+		return dest + path.Base(src)
+	}
+	return dest
+}
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageLsCmd, storageGetCmd, storagePutCmd, storageRmCmd, storageCpCmd, storageMvCmd, storageTreeCmd, storageMigrateCmd, storageCacheCmd, storageCheckCmd)
+	storageCacheCmd.AddCommand(storageCachePruneCmd)
+	storageCachePruneCmd.Flags().DurationVar(&cacheMaxAge, "max-age", 7*24*time.Hour, "removes the objects not used for longer, 0 removes every object")
+	storageLsCmd.Flags().BoolVarP(&storageRecursive, "recursive", "r", false, "lists the objects of the subdirectories too")
+	storageLsCmd.Flags().BoolVarP(&storageLong, "long", "l", false, "shows who uploaded each object, when and with which command")
+	storageRmCmd.Flags().BoolVarP(&storageRecursive, "recursive", "r", false, "removes every object below the path")
+	storageRmCmd.Flags().BoolVarP(&storageYes, "yes", "y", false, "does not ask for confirmation")
+	storageGetCmd.Flags().BoolVar(&storageForce, "force", false, "overwrites the local file")
+	storagePutCmd.Flags().BoolVar(&storageForce, "force", false, "overwrites the object in the bucket")
+	storageMigrateCmd.Flags().StringVar(&migrateFrom, "from", "", "config file of the source storage")
+	storageMigrateCmd.Flags().StringVar(&migrateTo, "to", "", "config file of the destination storage")
+	storageMigrateCmd.Flags().StringVar(&migrateOptions.StatePath, "state", "furyagent-migrate.json", "file recording the migrated objects, to resume an interrupted migration")
+	storageMigrateCmd.Flags().BoolVar(&migrateOptions.Overwrite, "overwrite", false, "replaces the objects of the destination with a different content")
+	storageMigrateCmd.MarkFlagRequired("from")
+	storageMigrateCmd.MarkFlagRequired("to")
+}
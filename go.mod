@@ -2,10 +2,13 @@ module github.com/sighupio/furyagent
 
 require (
 	contrib.go.opencensus.io/exporter/ocagent v0.3.0 // indirect
+	filippo.io/age v1.1.1
+	github.com/Azure/azure-sdk-for-go v32.5.0+incompatible
 	github.com/Showmax/go-fqdn v0.0.0-20180501083314-6f60894d629f // indirect
 	github.com/alecthomas/gometalinter v2.0.12+incompatible // indirect
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
 	github.com/araddon/gou v0.0.0-20190110011759-c797efecbb61 // indirect
+	github.com/aws/aws-sdk-go v1.23.4
 	github.com/bgentry/go-netrc v0.0.0-20140422174119-9fd32a8b3d3d // indirect
 	github.com/cenkalti/backoff/v4 v4.0.0
 	github.com/coreos/pkg v0.0.0-20180108230652-97fdf19511ea // indirect
@@ -30,6 +33,7 @@ require (
 	github.com/jstemmer/gotags v1.4.1 // indirect
 	github.com/kisielk/errcheck v1.2.0 // indirect
 	github.com/klauspost/asmfmt v1.2.0 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/koron/iferr v0.0.0-20180615142939-bb332a3b1d91 // indirect
 	github.com/lytics/cloudstorage v0.2.2 // indirect
 	github.com/marstr/guid v1.1.0 // indirect
@@ -55,6 +59,9 @@ require (
 	go.etcd.io/etcd v0.0.0-20181014065228-dac8c6fcc05b
 	go.uber.org/zap v1.9.1
 	golang.org/x/arch v0.0.0-20181203225421-5a4828bb7045 // indirect
+	golang.org/x/crypto v0.4.0
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	google.golang.org/api v0.8.0
 	gopkg.in/alecthomas/kingpin.v3-unstable v3.0.0-20180810215634-df19058c872c // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 	gopkg.in/yaml.v2 v2.2.2
@@ -0,0 +1,216 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultStateFile is where the agent keeps its State when stateFile is not configured
+const DefaultStateFile = "/var/lib/furyagent/agent-state.json"
+
+// Config is the agent section of the furyagent.yml
+type Config struct {
+	StateFile string `mapstructure:"stateFile"`
+	// Jitter is nil when not configured, 0 disables it
+	Jitter *float64 `mapstructure:"jitter"`
+	// SSHKeysFrequency is the interval between two `configure ssh-keys`, 0 disables it
+	SSHKeysFrequency time.Duration `mapstructure:"sshKeysFrequency"`
+	// CRLFrequency is the interval between two downloads of the OpenVPN CRL, 0 disables it
+	CRLFrequency time.Duration `mapstructure:"crlFrequency"`
+}
+
+// Validate rejects a jitter that would make the waits negative
+func (c Config) Validate() error {
+	if c.Jitter != nil && (*c.Jitter < 0 || *c.Jitter >= 1) {
+		return fmt.Errorf("agent.jitter must be in [0, 1), got %v", *c.Jitter)
+	}
+	return nil
+}
+
+// DefaultJitter is the fraction of its interval a task is moved earlier or later at random
+const DefaultJitter = 0.1
+
+// Task is a job run periodically by the agent
+type Task struct {
+	Name     string
+	Interval time.Duration
+	Run      func() error
+}
+
+// TaskState is what the agent remembers of a task across restarts
+type TaskState struct {
+	LastRun     time.Time `json:"lastRun"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	Runs        int       `json:"runs"`
+	Failures    int       `json:"failures"`
+}
+
+// State is persisted in Agent.StatePath after every run
+type State struct {
+	Tasks map[string]*TaskState `json:"tasks"`
+}
+
+// Agent runs every task at its interval until its context is cancelled
+type Agent struct {
+	Tasks []Task
+	// StatePath keeps the State, so a restarted agent does not run again the tasks run recently
+	StatePath string
+	// Jitter is the fraction of the interval added or removed at random from every wait, DefaultJitter if nil
+	Jitter *float64
+
+	mu    sync.Mutex
+	state *State
+}
+
+// LoadState reads the State in path, empty if the file does not exist
+func LoadState(path string) (*State, error) {
+	state := &State{Tasks: map[string]*TaskState{}}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	if state.Tasks == nil {
+		state.Tasks = map[string]*TaskState{}
+	}
+	return state, nil
+}
+
+// Run schedules the tasks and blocks until ctx is cancelled. The tasks running
+// at that moment are waited for, so a backup is never interrupted halfway.
+func (a *Agent) Run(ctx context.Context) error {
+	state, err := LoadState(a.StatePath)
+	if err != nil {
+		return err
+	}
+	a.state = state
+	var wg sync.WaitGroup
+	for _, task := range a.Tasks {
+		wg.Add(1)
+		go func(task Task) {
+			defer wg.Done()
+			a.schedule(ctx, task)
+		}(task)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (a *Agent) schedule(ctx context.Context, task Task) {
+	wait := a.firstWait(task, time.Now())
+	for {
+		log.Printf("next %s in %v", task.Name, wait.Round(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		a.run(task)
+		wait = a.jitter(task.Interval)
+	}
+}
+
+// firstWait is the time left until the next run of task, according to its last run
+func (a *Agent) firstWait(task Task, now time.Time) time.Duration {
+	a.mu.Lock()
+	last, ok := a.state.Tasks[task.Name]
+	a.mu.Unlock()
+	if ok {
+		if left := last.LastRun.Add(task.Interval).Sub(now); left > 0 {
+			return left
+		}
+	}
+	// spread the overdue tasks of the nodes restarted together
+	return time.Duration(rand.Float64() * a.jitterFraction() * float64(task.Interval))
+}
+
+func (a *Agent) jitterFraction() float64 {
+	if a.Jitter == nil {
+		return DefaultJitter
+	}
+	return *a.Jitter
+}
+
+// jitter returns interval moved earlier or later by up to the jitter fraction
+func (a *Agent) jitter(interval time.Duration) time.Duration {
+	return interval + time.Duration((rand.Float64()*2-1)*a.jitterFraction()*float64(interval))
+}
+
+func (a *Agent) run(task Task) {
+	log.Printf("running %s", task.Name)
+	start := time.Now()
+	err := task.Run()
+	if err != nil {
+		log.Printf("%s failed after %v: %v", task.Name, time.Since(start).Round(time.Millisecond), err)
+	} else {
+		log.Printf("%s completed in %v", task.Name, time.Since(start).Round(time.Millisecond))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.state.Tasks[task.Name]
+	if !ok {
+		s = new(TaskState)
+		a.state.Tasks[task.Name] = s
+	}
+	s.LastRun = start.UTC()
+	s.Runs++
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+	} else {
+		s.LastSuccess = start.UTC()
+		s.LastError = ""
+	}
+	if err := a.saveState(); err != nil {
+		log.Printf("Cannot save the agent state: %v", err)
+	}
+}
+
+// saveState writes the state through a temporary file, so a crash never leaves it truncated
+func (a *Agent) saveState() error {
+	if a.StatePath == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.StatePath), 0700); err != nil {
+		return err
+	}
+	tmp := a.StatePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.StatePath)
+}
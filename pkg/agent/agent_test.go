@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunPersistsState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	var ok, failed int32
+	a := &Agent{
+		StatePath: statePath,
+		Tasks: []Task{
+			{Name: "ok", Interval: 20 * time.Millisecond, Run: func() error { atomic.AddInt32(&ok, 1); return nil }},
+			{Name: "failing", Interval: 20 * time.Millisecond, Run: func() error { atomic.AddInt32(&failed, 1); return errors.New("boom") }},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if err := a.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&ok) < 2 || atomic.LoadInt32(&failed) < 2 {
+		t.Fatalf("tasks ran %d and %d times, want at least 2", ok, failed)
+	}
+
+	state, err := LoadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := state.Tasks["ok"]; s == nil || s.Runs != int(ok) || s.Failures != 0 || s.LastSuccess.IsZero() {
+		t.Errorf("unexpected state of ok: %+v", s)
+	}
+	if s := state.Tasks["failing"]; s == nil || s.Failures != int(failed) || s.LastError != "boom" || !s.LastSuccess.IsZero() {
+		t.Errorf("unexpected state of failing: %+v", s)
+	}
+}
+
+func TestFirstWaitResumesFromState(t *testing.T) {
+	now := time.Now()
+	task := Task{Name: "backup", Interval: time.Hour}
+	a := &Agent{state: &State{Tasks: map[string]*TaskState{"backup": {LastRun: now.Add(-20 * time.Minute)}}}}
+	if wait := a.firstWait(task, now); wait != 40*time.Minute {
+		t.Errorf("got %v, want 40m after a run 20m ago", wait)
+	}
+	a.state.Tasks["backup"].LastRun = now.Add(-2 * time.Hour)
+	if wait := a.firstWait(task, now); wait < 0 || wait > 6*time.Minute {
+		t.Errorf("got %v, want an overdue task within the jitter", wait)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	jitter := 0.2
+	a := &Agent{Jitter: &jitter}
+	for i := 0; i < 100; i++ {
+		if wait := a.jitter(time.Hour); wait < 48*time.Minute || wait > 72*time.Minute {
+			t.Fatalf("got %v, want 1h ± 20%%", wait)
+		}
+	}
+}
+
+func TestValidateJitter(t *testing.T) {
+	for jitter, valid := range map[float64]bool{0: true, 0.5: true, 1: false, 1.5: false, -0.1: false} {
+		jitter := jitter
+		if err := (Config{Jitter: &jitter}).Validate(); (err == nil) != valid {
+			t.Errorf("jitter %v: got %v, valid %v", jitter, err, valid)
+		}
+	}
+}
+
+func TestJitterDisabled(t *testing.T) {
+	if wait := (&Agent{}).jitter(time.Hour); wait < 54*time.Minute || wait > 66*time.Minute {
+		t.Fatalf("got %v, want 1h ± the default jitter", wait)
+	}
+	disabled := 0.0
+	a := &Agent{Jitter: &disabled}
+	for i := 0; i < 100; i++ {
+		if wait := a.jitter(time.Hour); wait != time.Hour {
+			t.Fatalf("got %v with the jitter disabled", wait)
+		}
+	}
+}
@@ -66,6 +66,13 @@ type EtcdConfig struct {
 	SnapshotFile        string `mapstructure:"snapshotFile"`
 	ClientKeyFilename   string `mapstructure:"clientKeyFilename"`
 	Endpoint            string `mapstructure:"endpoint"`
+	// Members lists every member of an HA cluster, see EtcdMember
+	Members []EtcdMember `mapstructure:"members"`
+	// BackupRetention keeps every snapshot younger than it, see SnapshotRetention
+	BackupRetention time.Duration     `mapstructure:"backupRetention"`
+	BackupKeep      SnapshotRetention `mapstructure:"backupKeep"`
+	// BackupFrequency is the interval between the backups taken by `furyagent agent run`
+	BackupFrequency time.Duration `mapstructure:"backupFrequency"`
 }
 
 // MasterConfig is used to backup/restore/configure master nodes
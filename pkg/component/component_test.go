@@ -0,0 +1,16 @@
+package component
+
+import (
+	"testing"
+
+	"github.com/sighupio/furyagent/pkg/storage"
+)
+
+// newTestComponentData returns a ClusterComponentData backed by an in-memory bucket
+func newTestComponentData(t *testing.T, cfg *ClusterConfig) ClusterComponentData {
+	store, err := storage.NewData(storage.NewMemoryBackend(), &storage.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ClusterComponentData{cfg, store}
+}
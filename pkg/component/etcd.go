@@ -16,12 +16,17 @@ package component
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/sighupio/furyagent/pkg/planner"
+	"github.com/sighupio/furyagent/pkg/storage"
 	"go.etcd.io/etcd/clientv3"
 	"go.etcd.io/etcd/clientv3/snapshot"
 	"go.etcd.io/etcd/pkg/transport"
@@ -42,9 +47,9 @@ type Etcd struct {
 	ClusterComponentData
 }
 
-func getEtcdCfg(c EtcdConfig) (*clientv3.Config, error) {
+func getEtcdCfg(c EtcdConfig, endpoints []string) (*clientv3.Config, error) {
 	cfg := clientv3.Config{
-		Endpoints:   []string{c.Endpoint},
+		Endpoints:   endpoints,
 		DialTimeout: 5 * time.Second,
 	}
 	// Setup TLS config if CAFile is provided into configurations
@@ -64,63 +69,240 @@ func getEtcdCfg(c EtcdConfig) (*clientv3.Config, error) {
 	return &cfg, nil
 }
 
-func getBucketPathEtcd(c *ClusterConfig) string {
-	return filepath.Join("etcd", c.NodeName, SnapshotFilenameBucket)
-}
-
 // Backup implements
 func (e Etcd) Backup() error {
-	cfg, err := getEtcdCfg(e.Etcd)
+	endpoints, err := e.Etcd.clientEndpoints(e.NodeName)
 	if err != nil {
 		return err
 	}
-	sp := snapshot.NewV3(zap.NewExample())
-	err = sp.Save(context.Background(), *cfg, e.Etcd.SnapshotFile)
+	cfg, err := getEtcdCfg(e.Etcd, endpoints)
 	if err != nil {
 		return err
 	}
-	e.UploadFile(getBucketPathEtcd(e.ClusterConfig), e.Etcd.SnapshotFile+fmt.Sprintf("%v", time.Now().Unix()))
-	return err
+	key, resume := storage.PendingUpload(e.Etcd.SnapshotFile)
+	if resume && e.Exists(key) {
+		// the upload completed but its state was left behind
+		if err := storage.DiscardPendingUpload(e.Etcd.SnapshotFile); err != nil {
+			return err
+		}
+		resume = false
+	}
+	if resume {
+		log.Printf("resuming the interrupted upload of %s to %s", e.Etcd.SnapshotFile, key)
+	} else {
+		key = snapshotKey(e.NodeName, time.Now())
+		err = planner.Do("save an etcd snapshot to "+e.Etcd.SnapshotFile, func() error {
+			sp := snapshot.NewV3(zap.NewExample())
+			return sp.Save(context.Background(), *cfg, e.Etcd.SnapshotFile)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// a corrupted snapshot is never uploaded, so it cannot replace the latest good one
+	var status snapshot.Status
+	err = planner.Do("verify the etcd snapshot "+e.Etcd.SnapshotFile, func() error {
+		status, err = verifySnapshot(e.Etcd.SnapshotFile, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// snapshots can be several GB, upload them in parts when the provider allows it
+	if err := e.UploadFileMultipart(key, e.Etcd.SnapshotFile); err != nil {
+		return err
+	}
+	if !planner.DryRun() {
+		if err := setSnapshotStatus(e.Data, key, status); err != nil {
+			return fmt.Errorf("Cannot store the status of %s: %w", key, err)
+		}
+	}
+	if err := setLatestSnapshot(e.Data, e.NodeName, key); err != nil {
+		return fmt.Errorf("Cannot point %s to %s: %w", SnapshotLatest, key, err)
+	}
+	return e.pruneSnapshots()
+}
+
+// pruneSnapshots removes the snapshots of the node the retention policy does not keep
+func (e Etcd) pruneSnapshots() error {
+	found, err := snapshots(e.Data, e.NodeName)
+	if err != nil {
+		return fmt.Errorf("Cannot list the etcd snapshots: %w", err)
+	}
+	for _, s := range e.Etcd.BackupKeep.expired(found, e.Etcd.BackupRetention, time.Now()) {
+		log.Printf("removing the expired etcd snapshot %s", s.Key)
+		if err := e.Remove(s.Key); err != nil {
+			return fmt.Errorf("Cannot remove the expired etcd snapshot %s: %w", s.Key, err)
+		}
+		if statusKey := snapshotStatusKey(s.Key); e.Exists(statusKey) {
+			if err := e.Remove(statusKey); err != nil {
+				return fmt.Errorf("Cannot remove the status of the expired etcd snapshot %s: %w", s.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots of node, of every node if empty, newest first and with their status
+func (e Etcd) ListSnapshots(node string) ([]Snapshot, error) {
+	found, err := snapshots(e.Data, node)
+	if err != nil {
+		return nil, err
+	}
+	for i := range found {
+		status, err := snapshotStatus(e.Data, found[i].Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found[i].Status = status
+	}
+	return found, nil
+}
+
+// chooseSnapshot returns the key of the snapshot opts selects among the ones of node
+func (e Etcd) chooseSnapshot(opts EtcdRestoreOptions, node string) (string, error) {
+	if opts.FromNode != "" {
+		node = opts.FromNode
+	}
+	switch {
+	case opts.Snapshot != "":
+		key := opts.Snapshot
+		if !strings.HasPrefix(key, "etcd/") {
+			key = path.Join("etcd", key)
+		}
+		if !e.Exists(key) {
+			return "", fmt.Errorf("etcd snapshot %s %w", key, storage.ErrNotFound)
+		}
+		return key, nil
+	case !opts.Before.IsZero():
+		found, err := snapshots(e.Data, node)
+		if err != nil {
+			return "", err
+		}
+		for _, s := range found {
+			if s.Time.Before(opts.Before) {
+				return s.Key, nil
+			}
+		}
+		return "", fmt.Errorf("no etcd snapshot of %s taken before %s: %w", node, opts.Before.UTC().Format(time.RFC3339), storage.ErrNotFound)
+	default:
+		return latestSnapshot(e.Data, node)
+	}
 }
 
-// Restore implements
+// LatestSnapshots returns the latest pointer, the last snapshot and its status of every node
+func (e Etcd) LatestSnapshots() ([]string, error) {
+	entries, err := e.Browse("etcd/", false)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		if !entry.Dir {
+			continue
+		}
+		node := path.Base(entry.Name)
+		key, err := latestSnapshot(e.Data, node)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if pointer := path.Join("etcd", node, SnapshotLatest); e.Exists(pointer) {
+			keys = append(keys, pointer)
+		}
+		keys = append(keys, key)
+		if statusKey := snapshotStatusKey(key); e.Exists(statusKey) {
+			keys = append(keys, statusKey)
+		}
+	}
+	return keys, nil
+}
+
+// Restore implements. Every member of an HA cluster restores the latest snapshot
+// of the first member, so that they all start from the same data.
 func (e Etcd) Restore() error {
-	// the snapshot location path
-	f, err := os.Create(e.Etcd.SnapshotFile)
+	return e.RestoreSnapshot(EtcdRestoreOptions{})
+}
+
+// RestoreSnapshot restores the snapshot selected by opts, see EtcdRestoreOptions.
+// Every member of an HA cluster must be restored with the same options.
+func (e Etcd) RestoreSnapshot(opts EtcdRestoreOptions) error {
+	members, err := e.Etcd.members(e.NodeName)
+	if err != nil {
+		return err
+	}
+	self, err := member(members, e.NodeName)
 	if err != nil {
 		return err
 	}
 	// downloading the snapshot to the snapshot location
-	bucketPath := getBucketPathEtcd(e.ClusterConfig)
-	err = e.Download(bucketPath, f)
+	bucketPath, err := e.chooseSnapshot(opts, members[0].Name)
+	if err != nil {
+		return err
+	}
+	log.Printf("restoring %s as member %s of %d", bucketPath, self.Name, len(members))
+	expected, err := snapshotStatus(e.Data, bucketPath)
+	if errors.Is(err, storage.ErrNotFound) {
+		log.Printf("%s has no stored status, only its integrity can be verified", bucketPath)
+	} else if err != nil {
+		return fmt.Errorf("Cannot read the status of %s: %w", bucketPath, err)
+	}
+	err = planner.Do(fmt.Sprintf("download %s to %s", bucketPath, e.Etcd.SnapshotFile), func() error {
+		f, err := os.Create(e.Etcd.SnapshotFile)
+		if err != nil {
+			return err
+		}
+		if err := e.Download(bucketPath, f); err != nil {
+			f.Close()
+			return err
+		}
+		// verified once complete on disk
+		return f.Close()
+	})
 	if err != nil {
 		log.Printf("no %s found in bucket\n", bucketPath)
 		return err
 	}
-	// removing bkups
-	backupDir := e.Etcd.DataDir + ".bkup"
-	err = os.RemoveAll(backupDir)
+	// the data directory is left untouched if the snapshot is not the one taken by the backup
+	err = planner.Do("verify the etcd snapshot "+e.Etcd.SnapshotFile, func() error {
+		_, err := verifySnapshot(e.Etcd.SnapshotFile, expected)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	// moving old data to original_name.bkup
-	err = os.Rename(e.Etcd.DataDir, backupDir)
+	// removing bkups and moving old data to original_name.bkup
+	backupDir := e.Etcd.DataDir + ".bkup"
+	err = planner.Do(fmt.Sprintf("move %s to %s", e.Etcd.DataDir, backupDir), func() error {
+		if _, err := os.Stat(e.Etcd.DataDir); os.IsNotExist(err) {
+			// a new member replacing a lost one has no data yet
+			log.Printf("%s does not exist, nothing to move", e.Etcd.DataDir)
+			return nil
+		}
+		if err := os.RemoveAll(backupDir); err != nil {
+			return err
+		}
+		return os.Rename(e.Etcd.DataDir, backupDir)
+	})
 	if err != nil {
 		return err
 	}
 	restoreConf := snapshot.RestoreConfig{
-		SnapshotPath: e.Etcd.SnapshotFile,
-		Name:         e.NodeName,
-		// probably we'll have to modify this part to handle ha etcd
-		InitialCluster:      fmt.Sprintf("%s=%s", e.NodeName, e.Etcd.Endpoint),
+		SnapshotPath:        e.Etcd.SnapshotFile,
+		Name:                self.Name,
+		InitialCluster:      initialCluster(members),
 		InitialClusterToken: e.Etcd.InitialClusterToken,
 		OutputDataDir:       e.Etcd.DataDir,
-		PeerURLs:            []string{e.Etcd.Endpoint},
+		PeerURLs:            self.PeerURLs,
 	}
 
-	sp := snapshot.NewV3(zap.NewExample())
-
-	return sp.Restore(restoreConf)
+	return planner.Do(fmt.Sprintf("restore %s into %s", e.Etcd.SnapshotFile, e.Etcd.DataDir), func() error {
+		sp := snapshot.NewV3(zap.NewExample())
+		return sp.Restore(restoreConf)
+	})
 }
 
 func (e Etcd) getFileMappings() [][]string {
@@ -139,7 +321,7 @@ func (e Etcd) Configure(overwrite bool) error {
 func (e Etcd) Init(dir string) error {
 	ca, privateKey, err := pki.NewCertificateAuthority(&CertConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	certs := map[string][]byte{
 		EtcdCaCrt: certutil.EncodeCertPEM(ca),
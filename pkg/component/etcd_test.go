@@ -1,10 +1,41 @@
 package component
 
-func TestTimeConsuming(t *testing.T) {
-	agentConfig, _ := InitAgent("furyagent.yml")
-	store, _ := storage.Init(&agentConfig.Storage)
-	cfg, _ := getEtcdCfg(c, store)
-	cli, _ := clientv3.New(*cfg)
-	defer cli.Close()
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
 
+	certutil "k8s.io/client-go/util/cert"
+)
+
+func TestEtcdInitConfigure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	etcd := Etcd{newTestComponentData(t, &ClusterConfig{
+		Etcd: EtcdConfig{
+			CertDir:        dir,
+			CaCertFilename: "ca.pem",
+			CaKeyFilename:  "ca-key.pem",
+		},
+	})}
+	if err := etcd.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := etcd.Configure(false); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := certutil.CertsFromFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certs[0].IsCA {
+		t.Fatal("etcd ca.pem is not a CA certificate")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -69,15 +69,15 @@ func (m Master) Init(dir string) error {
 	// remove, create and download new certs
 	caCert, caKey, err := pki.NewCertificateAuthority(&CertConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	saCert, saKey, err := pki.NewCertificateAuthority(&CertConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	fpCert, fpKey, err := pki.NewCertificateAuthority(&CertConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	certs := map[string][]byte{
 		MasterCaCrt:     certutil.EncodeCertPEM(caCert),
@@ -0,0 +1,99 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package component
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// EtcdMember is a member of the etcd cluster, restored with the same snapshot as the others
+type EtcdMember struct {
+	Name       string   `mapstructure:"name"`
+	PeerURLs   []string `mapstructure:"peerURLs"`
+	ClientURLs []string `mapstructure:"clientURLs"`
+}
+
+// members returns the members of the cluster. Without a members list the node
+// is the only member, with Endpoint as peer and client URL.
+func (c EtcdConfig) members(nodeName string) ([]EtcdMember, error) {
+	if len(c.Members) == 0 {
+		if c.Endpoint == "" {
+			return nil, fmt.Errorf("neither etcd members nor endpoint are configured")
+		}
+		return []EtcdMember{{Name: nodeName, PeerURLs: []string{c.Endpoint}, ClientURLs: []string{c.Endpoint}}}, nil
+	}
+	names := map[string]bool{}
+	for _, m := range c.Members {
+		if m.Name == "" {
+			return nil, fmt.Errorf("etcd member without a name")
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("etcd member %s is configured twice", m.Name)
+		}
+		names[m.Name] = true
+		if len(m.PeerURLs) == 0 {
+			return nil, fmt.Errorf("etcd member %s has no peerURLs", m.Name)
+		}
+		for _, u := range append(append([]string{}, m.PeerURLs...), m.ClientURLs...) {
+			if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid URL %q of etcd member %s", u, m.Name)
+			}
+		}
+	}
+	return c.Members, nil
+}
+
+// member returns the member called name
+func member(members []EtcdMember, name string) (EtcdMember, error) {
+	for _, m := range members {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return EtcdMember{}, fmt.Errorf("node %s is not one of the etcd members", name)
+}
+
+// initialCluster returns the initial cluster of members, the same on every member
+func initialCluster(members []EtcdMember) string {
+	var cluster []string
+	for _, m := range members {
+		for _, u := range m.PeerURLs {
+			cluster = append(cluster, m.Name+"="+u)
+		}
+	}
+	return strings.Join(cluster, ",")
+}
+
+// clientEndpoints returns the endpoints the backups are taken from: Endpoint if set,
+// the client URLs of the node otherwise
+func (c EtcdConfig) clientEndpoints(nodeName string) ([]string, error) {
+	if c.Endpoint != "" {
+		return []string{c.Endpoint}, nil
+	}
+	members, err := c.members(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	m, err := member(members, nodeName)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.ClientURLs) == 0 {
+		return nil, fmt.Errorf("etcd member %s has no clientURLs", nodeName)
+	}
+	return m.ClientURLs, nil
+}
@@ -0,0 +1,54 @@
+package component
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInitialCluster(t *testing.T) {
+	c := EtcdConfig{Members: []EtcdMember{
+		{Name: "etcd-1", PeerURLs: []string{"https://10.0.0.1:2380"}, ClientURLs: []string{"https://10.0.0.1:2379"}},
+		{Name: "etcd-2", PeerURLs: []string{"https://10.0.0.2:2380"}, ClientURLs: []string{"https://10.0.0.2:2379"}},
+		{Name: "etcd-3", PeerURLs: []string{"https://10.0.0.3:2380", "https://etcd-3:2380"}},
+	}}
+	members, err := c.members("etcd-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "etcd-1=https://10.0.0.1:2380,etcd-2=https://10.0.0.2:2380,etcd-3=https://10.0.0.3:2380,etcd-3=https://etcd-3:2380"
+	if cluster := initialCluster(members); cluster != expected {
+		t.Fatalf("got %s, expected %s", cluster, expected)
+	}
+	if endpoints, err := c.clientEndpoints("etcd-2"); err != nil || !reflect.DeepEqual(endpoints, []string{"https://10.0.0.2:2379"}) {
+		t.Fatalf("unexpected client endpoints %v (%v)", endpoints, err)
+	}
+	if _, err := c.clientEndpoints("etcd-3"); err == nil {
+		t.Fatal("expected an error for a member without client URLs")
+	}
+	if _, err := member(members, "etcd-4"); err == nil {
+		t.Fatal("expected an error for a node outside the members")
+	}
+}
+
+func TestMembersSingleNode(t *testing.T) {
+	members, err := EtcdConfig{Endpoint: "https://localhost:2380"}.members("etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster := initialCluster(members); cluster != "etcd=https://localhost:2380" {
+		t.Fatalf("unexpected initial cluster %s", cluster)
+	}
+}
+
+func TestMembersValidation(t *testing.T) {
+	for name, members := range map[string][]EtcdMember{
+		"no name":      {{PeerURLs: []string{"https://10.0.0.1:2380"}}},
+		"duplicate":    {{Name: "a", PeerURLs: []string{"https://10.0.0.1:2380"}}, {Name: "a", PeerURLs: []string{"https://10.0.0.2:2380"}}},
+		"no peer URLs": {{Name: "a", ClientURLs: []string{"https://10.0.0.1:2379"}}},
+		"invalid URL":  {{Name: "a", PeerURLs: []string{"10.0.0.1:2380"}}},
+	} {
+		if _, err := (EtcdConfig{Members: members}).members("a"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/sighupio/furyagent/pkg/planner"
 )
 
 const (
@@ -73,7 +74,7 @@ func (n Node) Configure(overwrite bool) error {
 	}
 	err := backoff.RetryNotify(bn.executeCommand, b, notify)
 	if err != nil {
-		log.Fatalf("join command exit abnormally after %v of retry with error: %v", b.MaxElapsedTime, err)
+		return fmt.Errorf("join command exit abnormally after %v of retry with error: %w", b.MaxElapsedTime, err)
 	}
 	return nil
 }
@@ -102,7 +103,9 @@ func (b BackoffNode) executeCommand() error {
 		return err
 	}
 
-	err = addNodeName(path.Join(LocalJoinFilePath, JoinFile))
+	err = planner.Do("add the node name to "+path.Join(LocalJoinFilePath, JoinFile), func() error {
+		return addNodeName(path.Join(LocalJoinFilePath, JoinFile))
+	})
 	if err != nil {
 		return err
 	}
@@ -111,7 +114,7 @@ func (b BackoffNode) executeCommand() error {
 	output := new(bytes.Buffer)
 	cmd.Stdout = output
 	cmd.Stderr = output
-	err = cmd.Run()
+	err = planner.Run(cmd)
 	if err != nil {
 		return fmt.Errorf("error: %v, output: %s", err, output.String())
 	}
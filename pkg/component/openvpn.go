@@ -8,7 +8,6 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"io/ioutil"
-	"log"
 	"math/big"
 	"os"
 	"os/exec"
@@ -56,11 +55,17 @@ func (o OpenVPN) Configure(overwrite bool) error {
 	return o.DownloadFilesToDirectory(files, o.OpenVPN.CertDir, OpenVPNPath, overwrite)
 }
 
+// SyncCRL downloads the revocation list only, so the server refuses the clients revoked after Configure
+func (o OpenVPN) SyncCRL() error {
+	files := [][]string{{OpenVPNCRL, OpenVPNCRL}}
+	return o.DownloadFilesToDirectory(files, o.OpenVPN.CertDir, OpenVPNPath, true)
+}
+
 func (o OpenVPN) Init(dir string) error {
 	now := time.Now()
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	tmpl := x509.Certificate{
 		SerialNumber: new(big.Int).SetInt64(0),
@@ -76,11 +81,11 @@ func (o OpenVPN) Init(dir string) error {
 	}
 	caDERBytes, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, privateKey.Public(), privateKey)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	ca, err := x509.ParseCertificate(caDERBytes)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	crl, err := ca.CreateCRL(rand.Reader, privateKey, []pkix.RevokedCertificate{}, now, now.AddDate(10, 0, 0).UTC())
@@ -98,12 +103,12 @@ func (o OpenVPN) Init(dir string) error {
 
 	serverCert, serverKey, err := pki.NewCertAndKey(ca, privateKey, &CertConfig)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	taKeyData, err := getTaKey()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	certs := map[string][]byte{
@@ -114,10 +119,7 @@ func (o OpenVPN) Init(dir string) error {
 		OpenVPNCRL:        crlBuffer.Bytes(),
 		OpenVPNTaKey:      taKeyData,
 	}
-	if err = o.UploadFilesFromMemory(certs, OpenVPNPath); err != nil {
-		log.Fatal(err)
-	}
-	return nil
+	return o.UploadFilesFromMemory(certs, OpenVPNPath)
 }
 
 func getTaKey() ([]byte, error) {
@@ -2,10 +2,14 @@ package component
 
 import (
 	"fmt"
+	"os/exec"
 	"testing"
 )
 
 func TestGenerateTaKey(t *testing.T) {
+	if _, err := exec.LookPath("openvpn"); err != nil {
+		t.Skip("openvpn is not installed")
+	}
 	data, err := getTaKey()
 	if err != nil {
 		t.Fail()
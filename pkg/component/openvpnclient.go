@@ -273,9 +273,8 @@ func (o OpenVPNClient) RevokeUser(clientName string) error {
 	filenames := []string{
 		OpenVPNCaCert,
 		OpenVPNCaKey,
-		OpenVPNCRL,
 	}
-	log.Println("Downloading ca.crt, ca.key, ca.crl")
+	log.Println("Downloading ca.crt, ca.key")
 	ca, err := o.DownloadFilesToMemory(filenames, OpenVPNPath)
 	if err != nil {
 		return err
@@ -286,18 +285,20 @@ func (o OpenVPNClient) RevokeUser(clientName string) error {
 		return err
 	}
 	log.Println("Revoking certificate for: ", clientName)
-	newCRL, err := o.revokeClientCertificate(ca[OpenVPNCaCert], ca[OpenVPNCaKey], ca[OpenVPNCRL], cert[clientName+".crt"])
+	// ca.crl is replaced only if nobody else revoked a certificate meanwhile, otherwise the revocation is applied again
+	err = o.Update(filepath.Join(OpenVPNPath, OpenVPNCRL), func(crl []byte) ([]byte, error) {
+		if crl == nil {
+			return nil, fmt.Errorf("%s not found", OpenVPNCRL)
+		}
+		newCRL, err := o.revokeClientCertificate(ca[OpenVPNCaCert], ca[OpenVPNCaKey], crl, cert[clientCert])
+		if err != nil {
+			return nil, err
+		}
+		return newCRL[OpenVPNCRL], nil
+	})
 	if err != nil {
 		return err
 	}
-	log.Println("Removing old ca.crl")
-	if err = o.Remove(filepath.Join(OpenVPNPath, OpenVPNCRL)); err != nil {
-		return err
-	}
-	log.Println("Uploading new ca.crl")
-	if err = o.UploadFilesFromMemory(newCRL, OpenVPNPath); err != nil {
-		return err
-	}
 	log.Println("Moving certificate to revoked folder for: ", clientName)
 	if err := o.Move(clientName+".crt", OpenVPNClientPath, OpenVPNClientRevokedPath); err != nil {
 		return err
@@ -0,0 +1,92 @@
+package component
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+	"time"
+
+	certutil "k8s.io/client-go/util/cert"
+	pki "k8s.io/kubernetes/cmd/kubeadm/app/util/pkiutil"
+)
+
+// uploadTestVPNCA stores in the bucket the files OpenVPN.Init would create, without calling openvpn
+func uploadTestVPNCA(t *testing.T, data ClusterComponentData) {
+	ca, key, err := pki.NewCertificateAuthority(&CertConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	crl, err := ca.CreateCRL(rand.Reader, key, []pkix.RevokedCertificate{}, now, now.AddDate(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlBuffer := new(bytes.Buffer)
+	if err := pem.Encode(crlBuffer, &pem.Block{Type: "X509 CRL", Bytes: crl}); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		OpenVPNCaCert: certutil.EncodeCertPEM(ca),
+		OpenVPNCaKey:  certutil.EncodePrivateKeyPEM(key),
+		OpenVPNCRL:    crlBuffer.Bytes(),
+		OpenVPNTaKey:  []byte("ta"),
+	}
+	if err := data.UploadFilesFromMemory(files, OpenVPNPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenVPNClientCreateAndRevoke(t *testing.T) {
+	o := OpenVPNClient{newTestComponentData(t, &ClusterConfig{
+		OpenVPN: OpenVPNConfig{Servers: []string{"vpn.example.com:1194"}},
+	})}
+	uploadTestVPNCA(t, o.ClusterComponentData)
+
+	if err := o.CreateUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !o.Exists(filepath.Join(OpenVPNClientPath, "alice.crt")) {
+		t.Fatal("client certificate was not uploaded")
+	}
+	if o.Exists(filepath.Join(OpenVPNClientPath, "alice.key")) {
+		t.Fatal("client private key must not be uploaded")
+	}
+	if err := o.CreateUser("alice"); err == nil {
+		t.Fatal("creating the same user twice must fail")
+	}
+
+	cert, err := o.DownloadFilesToMemory([]string{"alice.crt"}, OpenVPNClientPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RevokeUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if o.Exists(filepath.Join(OpenVPNClientPath, "alice.crt")) {
+		t.Fatal("revoked certificate was not moved")
+	}
+	if !o.Exists(filepath.Join(OpenVPNClientRevokedPath, "alice.crt")) {
+		t.Fatal("revoked certificate is missing from the revoked folder")
+	}
+
+	ca, err := o.DownloadFilesToMemory([]string{OpenVPNCRL}, OpenVPNPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(ca[OpenVPNCRL])
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(cert["alice.crt"])
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !getRevocationInfo(crt, crl.TBSCertList.RevokedCertificates).Revoked {
+		t.Fatal("certificate is not listed in the CRL")
+	}
+}
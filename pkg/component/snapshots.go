@@ -0,0 +1,219 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package component
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sighupio/furyagent/pkg/storage"
+	"go.etcd.io/etcd/clientv3/snapshot"
+	"go.uber.org/zap"
+)
+
+const (
+	// SnapshotLatest is the object of etcd/<node>/ holding the key of the last snapshot of the node
+	SnapshotLatest = "latest"
+
+	snapshotPrefix    = "snapshot-"
+	snapshotSuffix    = ".db"
+	snapshotStatusExt = ".json"
+	// snapshotTimeFormat parses the keys with or without the fraction of second of snapshotKeyTimeFormat
+	snapshotTimeFormat = "20060102T150405Z"
+	// snapshotKeyTimeFormat tells apart two snapshots taken in the same second, e.g. by a retry
+	snapshotKeyTimeFormat = "20060102T150405.000000000Z"
+)
+
+// SnapshotRetention is how many etcd snapshots are kept after a backup. A snapshot
+// is kept if it is younger than backupRetention, or if it is the newest of one of the
+// last Hourly hours, Daily days or Weekly weeks. Nothing is pruned when both are unset.
+type SnapshotRetention struct {
+	Hourly int `mapstructure:"hourly"`
+	Daily  int `mapstructure:"daily"`
+	Weekly int `mapstructure:"weekly"`
+}
+
+// Snapshot is an etcd snapshot in the bucket
+type Snapshot struct {
+	Key  string
+	Node string
+	Time time.Time
+	Size int64
+	// Status is read from the object next to the snapshot, nil for the snapshots taken without it
+	Status *snapshot.Status
+}
+
+// EtcdRestoreOptions selects the snapshot restored by Etcd.RestoreSnapshot. Without
+// options the latest snapshot of the first member is restored.
+type EtcdRestoreOptions struct {
+	// Snapshot is the key of the snapshot, as listed by `backup list etcd`
+	Snapshot string
+	// Before restores the last snapshot taken before it
+	Before time.Time
+	// FromNode restores a snapshot of another node, e.g. the one a new node replaces
+	FromNode string
+}
+
+// snapshotKey returns the key of the snapshot of node taken at t
+func snapshotKey(node string, t time.Time) string {
+	return path.Join("etcd", node, snapshotPrefix+t.UTC().Format(snapshotKeyTimeFormat)+snapshotSuffix)
+}
+
+// parseSnapshotKey returns the snapshot stored in key, false if key is not a timestamped snapshot
+func parseSnapshotKey(key string) (Snapshot, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] != "etcd" {
+		return Snapshot{}, false
+	}
+	name := parts[2]
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+		return Snapshot{}, false
+	}
+	t, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+	if err != nil {
+		return Snapshot{}, false
+	}
+	return Snapshot{Key: key, Node: parts[1], Time: t}, true
+}
+
+// snapshots returns the timestamped snapshots of node, every node if empty, newest first
+func snapshots(store *storage.Data, node string) ([]Snapshot, error) {
+	prefix := "etcd/"
+	if node != "" {
+		prefix = path.Join("etcd", node) + "/"
+	}
+	entries, err := store.Browse(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+	var found []Snapshot
+	for _, entry := range entries {
+		if s, ok := parseSnapshotKey(entry.Name); ok {
+			s.Size = entry.Size
+			found = append(found, s)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Time.After(found[j].Time)
+	})
+	return found, nil
+}
+
+// latestSnapshot returns the key of the last snapshot of node, the one written
+// before timestamped snapshots existed if it has no latest pointer
+func latestSnapshot(store *storage.Data, node string) (string, error) {
+	files, err := store.DownloadFilesToMemory([]string{SnapshotLatest}, path.Join("etcd", node))
+	if errors.Is(err, storage.ErrNotFound) {
+		legacy := path.Join("etcd", node, SnapshotFilenameBucket)
+		if store.Exists(legacy) {
+			return legacy, nil
+		}
+		return "", fmt.Errorf("no etcd snapshot of %s: %w", node, storage.ErrNotFound)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(files[SnapshotLatest])), nil
+}
+
+// snapshotStatusKey returns the key of the status of the snapshot stored in key
+func snapshotStatusKey(key string) string {
+	return strings.TrimSuffix(key, snapshotSuffix) + snapshotStatusExt
+}
+
+// snapshotStatus returns the status stored next to the snapshot in key
+func snapshotStatus(store *storage.Data, key string) (*snapshot.Status, error) {
+	dir, name := path.Split(snapshotStatusKey(key))
+	files, err := store.DownloadFilesToMemory([]string{name}, dir)
+	if err != nil {
+		return nil, err
+	}
+	status := new(snapshot.Status)
+	if err := json.Unmarshal(files[name], status); err != nil {
+		return nil, fmt.Errorf("invalid status of %s: %v", key, err)
+	}
+	return status, nil
+}
+
+// setSnapshotStatus stores status next to the snapshot in key
+func setSnapshotStatus(store *storage.Data, key string, status snapshot.Status) error {
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return store.UploadForce(snapshotStatusKey(key), int64(len(content)), ioutil.NopCloser(strings.NewReader(string(content))))
+}
+
+// verifySnapshot checks the integrity of the snapshot in file and returns its status.
+// With expected, the snapshot must also have its hash, revision and number of keys.
+func verifySnapshot(file string, expected *snapshot.Status) (snapshot.Status, error) {
+	status, err := snapshot.NewV3(zap.NewExample()).Status(file)
+	if err != nil {
+		return status, fmt.Errorf("corrupted etcd snapshot %s: %v", file, err)
+	}
+	if expected != nil && (status.Hash != expected.Hash || status.Revision != expected.Revision || status.TotalKey != expected.TotalKey) {
+		return status, fmt.Errorf("etcd snapshot %s has hash %d, revision %d and %d keys, its backup had hash %d, revision %d and %d keys",
+			file, status.Hash, status.Revision, status.TotalKey, expected.Hash, expected.Revision, expected.TotalKey)
+	}
+	log.Printf("etcd snapshot %s verified: hash %d, revision %d, %d keys, %d bytes", file, status.Hash, status.Revision, status.TotalKey, status.TotalSize)
+	return status, nil
+}
+
+// setLatestSnapshot points the latest pointer of node to key
+func setLatestSnapshot(store *storage.Data, node, key string) error {
+	return store.UploadForce(path.Join("etcd", node, SnapshotLatest), int64(len(key)), ioutil.NopCloser(strings.NewReader(key)))
+}
+
+// expired returns the snapshots, newest first, that the retention policy does not keep.
+// The newest snapshot is always kept.
+func (r SnapshotRetention) expired(snapshots []Snapshot, maxAge time.Duration, now time.Time) []Snapshot {
+	if maxAge == 0 && r.Hourly == 0 && r.Daily == 0 && r.Weekly == 0 {
+		return nil
+	}
+	buckets := []struct {
+		keep   int
+		period func(t time.Time) string
+		seen   map[string]bool
+	}{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006010215") }, map[string]bool{}},
+		{r.Daily, func(t time.Time) string { return t.Format("20060102") }, map[string]bool{}},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}, map[string]bool{}},
+	}
+	var expired []Snapshot
+	for i, s := range snapshots {
+		keep := i == 0 || (maxAge > 0 && now.Sub(s.Time) < maxAge)
+		for _, b := range buckets {
+			// the newest snapshot of each of the last keep periods
+			p := b.period(s.Time.UTC())
+			if !b.seen[p] && len(b.seen) < b.keep {
+				b.seen[p] = true
+				keep = true
+			}
+		}
+		if !keep {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
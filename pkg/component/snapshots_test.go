@@ -0,0 +1,190 @@
+package component
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sighupio/furyagent/pkg/storage"
+	"go.etcd.io/etcd/clientv3/snapshot"
+	"go.etcd.io/etcd/mvcc/backend"
+)
+
+func TestSnapshotRetention(t *testing.T) {
+	now := time.Date(2020, 3, 18, 12, 30, 0, 0, time.UTC)
+	// a snapshot every 6 hours for 30 days, newest first
+	var all []Snapshot
+	for i := 0; i < 30*4; i++ {
+		taken := now.Add(-time.Duration(i) * 6 * time.Hour)
+		key := snapshotKey("etcd-1", taken)
+		s, ok := parseSnapshotKey(key)
+		if !ok || !s.Time.Equal(taken) || s.Node != "etcd-1" {
+			t.Fatalf("cannot parse %s: %v", key, s)
+		}
+		all = append(all, s)
+	}
+	kept := func(r SnapshotRetention, maxAge time.Duration) int {
+		return len(all) - len(r.expired(all, maxAge, now))
+	}
+	if n := kept(SnapshotRetention{}, 0); n != len(all) {
+		t.Fatalf("%d snapshots kept without retention, expected all", n)
+	}
+	if n := kept(SnapshotRetention{}, 24*time.Hour); n != 4 {
+		t.Fatalf("%d snapshots younger than 24h kept, expected 4", n)
+	}
+	if n := kept(SnapshotRetention{Hourly: 100}, 0); n != 100 {
+		t.Fatalf("%d hourly snapshots kept, expected 100", n)
+	}
+	if n := kept(SnapshotRetention{Daily: 7}, 0); n != 7 {
+		t.Fatalf("%d daily snapshots kept, expected 7", n)
+	}
+	// the last 2 days overlap the 2 daily slots
+	if n := kept(SnapshotRetention{Daily: 2, Weekly: 4}, 0); n != 5 {
+		t.Fatalf("%d daily and weekly snapshots kept, expected 5", n)
+	}
+	if expired := (SnapshotRetention{Daily: 1}).expired(all[:1], 0, now); len(expired) != 0 {
+		t.Fatal("the newest snapshot expired")
+	}
+}
+
+func TestLatestSnapshot(t *testing.T) {
+	data := newTestComponentData(t, &ClusterConfig{NodeName: "etcd-1"})
+	if _, err := latestSnapshot(data.Data, "etcd-1"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := data.UploadFilesFromMemory(map[string][]byte{SnapshotFilenameBucket: []byte("old")}, "etcd/etcd-1"); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := latestSnapshot(data.Data, "etcd-1"); err != nil || key != "etcd/etcd-1/snapshot.db" {
+		t.Fatalf("expected the snapshot of the previous versions, got %s (%v)", key, err)
+	}
+	key := snapshotKey("etcd-1", time.Now())
+	if err := data.UploadFilesFromMemory(map[string][]byte{key[len("etcd/etcd-1/"):]: []byte("new")}, "etcd/etcd-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setLatestSnapshot(data.Data, "etcd-1", key); err != nil {
+		t.Fatal(err)
+	}
+	if latest, err := latestSnapshot(data.Data, "etcd-1"); err != nil || latest != key {
+		t.Fatalf("expected %s, got %s (%v)", key, latest, err)
+	}
+	found, err := snapshots(data.Data, "")
+	if err != nil || len(found) != 1 || found[0].Key != key {
+		t.Fatalf("unexpected snapshots %v (%v)", found, err)
+	}
+	etcd := Etcd{data}
+	keys, err := etcd.LatestSnapshots()
+	if err != nil || len(keys) != 2 || keys[0] != "etcd/etcd-1/"+SnapshotLatest || keys[1] != key {
+		t.Fatalf("unexpected latest snapshots %v (%v)", keys, err)
+	}
+}
+
+func TestChooseSnapshot(t *testing.T) {
+	etcd := Etcd{newTestComponentData(t, &ClusterConfig{NodeName: "etcd-new"})}
+	base := time.Date(2020, 3, 18, 12, 0, 0, 0, time.UTC)
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key := snapshotKey("etcd-1", base.Add(time.Duration(i)*time.Hour))
+		if err := etcd.UploadForce(key, 2, ioutil.NopCloser(strings.NewReader("db"))); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := setLatestSnapshot(etcd.Data, "etcd-1", keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := setSnapshotStatus(etcd.Data, keys[1], snapshot.Status{Hash: 1, Revision: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		opts     EtcdRestoreOptions
+		expected string
+	}{
+		{EtcdRestoreOptions{FromNode: "etcd-1"}, keys[2]},
+		{EtcdRestoreOptions{FromNode: "etcd-1", Before: base.Add(90 * time.Minute)}, keys[1]},
+		{EtcdRestoreOptions{Snapshot: strings.TrimPrefix(keys[0], "etcd/")}, keys[0]},
+		{EtcdRestoreOptions{Snapshot: keys[0]}, keys[0]},
+	} {
+		if key, err := etcd.chooseSnapshot(c.opts, "etcd-new"); err != nil || key != c.expected {
+			t.Errorf("%+v: expected %s, got %s (%v)", c.opts, c.expected, key, err)
+		}
+	}
+	if _, err := etcd.chooseSnapshot(EtcdRestoreOptions{FromNode: "etcd-1", Before: base}, "etcd-new"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound before the first snapshot, got %v", err)
+	}
+	if _, err := etcd.chooseSnapshot(EtcdRestoreOptions{}, "etcd-new"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a node without snapshots, got %v", err)
+	}
+
+	found, err := etcd.ListSnapshots("")
+	if err != nil || len(found) != 3 {
+		t.Fatalf("unexpected snapshots %v (%v)", found, err)
+	}
+	if found[1].Status == nil || found[1].Status.Revision != 42 || found[0].Status != nil || found[0].Size != 2 {
+		t.Fatalf("unexpected snapshots %+v", found)
+	}
+}
+
+// writeTestSnapshot writes an etcd database with the keys in file
+func writeTestSnapshot(t *testing.T, file string, keys ...string) {
+	be := backend.NewDefaultBackend(file)
+	tx := be.BatchTx()
+	tx.Lock()
+	tx.UnsafeCreateBucket([]byte("test"))
+	for _, k := range keys {
+		tx.UnsafePut([]byte("test"), []byte(k), []byte("value"))
+	}
+	tx.Unlock()
+	be.ForceCommit()
+	if err := be.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "snapshot.db")
+	writeTestSnapshot(t, file, "a", "b")
+	status, err := verifySnapshot(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.TotalKey != 2 {
+		t.Fatalf("expected 2 keys, got %+v", status)
+	}
+	if _, err := verifySnapshot(file, &status); err != nil {
+		t.Fatalf("the snapshot does not match its own status: %v", err)
+	}
+
+	other := filepath.Join(dir, "other.db")
+	writeTestSnapshot(t, other, "a", "c")
+	if _, err := verifySnapshot(other, &status); err == nil {
+		t.Fatal("expected an error for a snapshot with a different hash")
+	}
+
+	corrupted := filepath.Join(dir, "corrupted.db")
+	if err := ioutil.WriteFile(corrupted, []byte("not a snapshot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySnapshot(corrupted, nil); err == nil {
+		t.Fatal("expected an error for a corrupted snapshot")
+	}
+}
+
+func TestSnapshotKeyPrecision(t *testing.T) {
+	taken := time.Date(2020, 3, 18, 12, 30, 0, 0, time.UTC)
+	first, second := snapshotKey("etcd-1", taken), snapshotKey("etcd-1", taken.Add(time.Millisecond))
+	if first == second {
+		t.Fatalf("two snapshots taken in the same second share the key %s", first)
+	}
+	if s, ok := parseSnapshotKey(second); !ok || !s.Time.Equal(taken.Add(time.Millisecond)) {
+		t.Fatalf("cannot parse %s: %v", second, s)
+	}
+	if s, ok := parseSnapshotKey("etcd/etcd-1/snapshot-20200318T123000Z.db"); !ok || !s.Time.Equal(taken) {
+		t.Fatalf("cannot parse the keys without fraction of second: %v", s)
+	}
+}
@@ -2,6 +2,7 @@ package component
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	ioutil "io/ioutil"
 	"log"
@@ -15,6 +16,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sighupio/furyagent/pkg/planner"
+	"github.com/sighupio/furyagent/pkg/storage"
 	"gopkg.in/yaml.v2"
 )
 
@@ -74,7 +77,7 @@ func (o SSHComponent) Configure(overwrite bool) error {
 	files := o.getFiles()
 	err := o.DownloadFilesToDirectory(files, o.SSH.TempDir, SSHBucketDir, overwrite)
 	if err != nil {
-		log.Fatal("error downloading files ", err)
+		return fmt.Errorf("error downloading files: %w", err)
 	}
 	return sshPubKeys(o.SSH)
 }
@@ -99,61 +102,76 @@ func getKeysFromAdapter(config SSHConfig, yamlSPec SSHUsersFile) (*bytes.Buffer,
 func sshPubKeys(config SSHConfig) error {
 	//parse the ssh-user file
 	sshYaml, err := unmarshalSSHUserYaml(config.TempDir, config)
-	authorizedKeys := &bytes.Buffer{}
-	authorizedKeys, errorFound, err = getKeysFromAdapter(config, sshYaml)
-	var sysUser *SystemUser
-	sysUser, err = createUser(config.User)
-	if err != nil {
-		log.Fatal("error while creating user", err)
-	}
-
-	homeUserSSH := path.Join(sysUser.Home, ".ssh")
-
-	log.Printf("creating temporary authorizedKeys file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)))
-	f, err := os.Create(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName))
 	if err != nil {
 		return err
 	}
-	//write the buffer into the temporary authorized_keys file
-	_, err = f.Write([]byte(authorizedKeys.String()))
+	authorizedKeys := &bytes.Buffer{}
+	authorizedKeys, errorFound, err = getKeysFromAdapter(config, sshYaml)
 	if err != nil {
 		return err
 	}
-	err = os.Chown(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName), sysUser.Uid, sysUser.Gid)
+	var sysUser *SystemUser
+	sysUser, err = createUser(config.User)
 	if err != nil {
-		log.Printf("error while changing ownership to file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)))
+		return fmt.Errorf("error while creating user: %w", err)
 	}
 
-	//Once finished, copy it to the the real authorized_keys file if everything went ok
-	if errorFound {
-		log.Fatal("conservative behaviour: error found, skipping the authorized_keys update")
-	}
-	log.Printf("everything is fine! Writing temp file %s to its final destination %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)), string(path.Join(homeUserSSH, SSHAuthorizedKeysFileName)))
-	err = os.Rename(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName), path.Join(homeUserSSH, SSHAuthorizedKeysFileName))
-	if err != nil {
-		log.Fatal("error while moving file to authorized_keys: ", err)
-	}
-	err = os.Chown(path.Join(homeUserSSH, SSHAuthorizedKeysFileName), sysUser.Uid, sysUser.Gid)
-	if err != nil {
-		log.Printf("error while changing ownership to file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysFileName)))
-	}
-	return nil
+	homeUserSSH := path.Join(sysUser.Home, ".ssh")
+	return planner.Do("write "+path.Join(homeUserSSH, SSHAuthorizedKeysFileName), func() error {
+		log.Printf("creating temporary authorizedKeys file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)))
+		f, err := os.Create(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName))
+		if err != nil {
+			return err
+		}
+		//write the buffer into the temporary authorized_keys file
+		_, err = f.Write([]byte(authorizedKeys.String()))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName))
+			return err
+		}
+		err = os.Chown(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName), sysUser.Uid, sysUser.Gid)
+		if err != nil {
+			log.Printf("error while changing ownership to file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)))
+		}
+
+		//Once finished, copy it to the the real authorized_keys file if everything went ok
+		if errorFound {
+			os.Remove(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName))
+			return errors.New("conservative behaviour: error found, skipping the authorized_keys update")
+		}
+		log.Printf("everything is fine! Writing temp file %s to its final destination %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName)), string(path.Join(homeUserSSH, SSHAuthorizedKeysFileName)))
+		err = os.Rename(path.Join(homeUserSSH, SSHAuthorizedKeysTempFileName), path.Join(homeUserSSH, SSHAuthorizedKeysFileName))
+		if err != nil {
+			return fmt.Errorf("error while moving file to authorized_keys: %w", err)
+		}
+		err = os.Chown(path.Join(homeUserSSH, SSHAuthorizedKeysFileName), sysUser.Uid, sysUser.Gid)
+		if err != nil {
+			log.Printf("error while changing ownership to file %s", string(path.Join(homeUserSSH, SSHAuthorizedKeysFileName)))
+		}
+		return nil
+	})
 }
 
-func GetUidGid(username string) (uid, gid int) {
+// GetUidGid returns the uid and the gid of username, storage.ErrNotFound if it does not exist
+func GetUidGid(username string) (uid, gid int, err error) {
 	userInfo, err := user.Lookup(username)
-	if err != nil {
-		log.Fatal(err)
+	if _, ok := err.(user.UnknownUserError); ok {
+		return 0, 0, fmt.Errorf("user %s %w", username, storage.ErrNotFound)
+	} else if err != nil {
+		return 0, 0, err
 	}
 	uid, err = strconv.Atoi(userInfo.Uid)
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, err
 	}
-	gid, err = strconv.Atoi(userInfo.Uid)
+	gid, err = strconv.Atoi(userInfo.Gid)
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, err
 	}
-	return uid, gid
+	return uid, gid, nil
 }
 
 //Init will upload to the configured bucket the ssh file users
@@ -168,11 +186,11 @@ func unmarshalSSHUserYaml(dirPath string, config SSHConfig) (SSHUsersFile, error
 	log.Printf("loading spec file %s", string(path.Join(dirPath, SSHUserSpecs)))
 	fileRead, err := ioutil.ReadFile(string(path.Join(dirPath, SSHUserSpecs)))
 	if err != nil {
-		log.Fatal("no file found to open in "+path.Join(dirPath, SSHUserSpecs), err)
+		return sshYaml, fmt.Errorf("no file found to open in %s: %w", path.Join(dirPath, SSHUserSpecs), err)
 	}
 	err = yaml.Unmarshal(fileRead, &sshYaml)
 	if err != nil {
-		log.Fatal("unable to unmarshal file "+path.Join(dirPath, SSHUserSpecs), err)
+		return sshYaml, fmt.Errorf("unable to unmarshal file %s: %w", path.Join(dirPath, SSHUserSpecs), err)
 	}
 	return sshYaml, nil
 }
@@ -187,19 +205,22 @@ func getPublicKeyFromHttp(adapter HTTPAdapterSet, userspec UserSpec, authorizedK
 		baseURL = "https://github.com"
 	case "http":
 		if adapter.Uri == "" {
-			log.Fatal("the uri field cannot be empty if adapter http is specified")
+			return authorizedKeys, errors.New("the uri field cannot be empty if adapter http is specified")
 		}
 		baseURL = adapter.Uri
 	default:
-		log.Fatalf("the current adapter %s is not supported", adapter.Name)
+		return authorizedKeys, fmt.Errorf("the current adapter %s is not supported", adapter.Name)
 	}
 	u, err := url.Parse(baseURL)
+	if err != nil {
+		return authorizedKeys, err
+	}
 	//the structure of the http `github-agnostic` must be the same of github: every user must have a file `user.keys`
 	u.Path = path.Join(u.Path, userspec.UserID+".keys")
 	s := u.String()
 	resp, err := client.Get(s)
 	if err != nil {
-		log.Fatal("http protocol error: ", err)
+		return authorizedKeys, fmt.Errorf("http protocol error: %w", err)
 	}
 	if resp.StatusCode == 200 {
 		buf := new(bytes.Buffer)
@@ -218,10 +239,10 @@ func getPublicKeyFromHttp(adapter HTTPAdapterSet, userspec UserSpec, authorizedK
 	return authorizedKeys, nil
 }
 
-func getOS() string {
+func getOS() (string, error) {
 	b, err := ioutil.ReadFile("/etc/os-release")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	s := strings.Split(string(b), "\n")
 	version := ""
@@ -233,27 +254,26 @@ func getOS() string {
 		}
 	}
 
-	if version != "" {
-		return version
-	}
-	return ""
+	return version, nil
 }
 
-func getAdduserCommand(home, username string) []string {
-
-	switch strings.ToLower(getOS()) {
+func getAdduserCommand(home, username string) ([]string, error) {
+	osID, err := getOS()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(osID) {
 	case "debian", "ubuntu":
-		log.Printf("os identified is %s: ", strings.ToLower(getOS()))
+		log.Printf("os identified is %s: ", strings.ToLower(osID))
 		cmd := []string{"adduser", "--home", home, "--disabled-password", username}
-		return cmd
+		return cmd, nil
 	case "centos", "redhat", "ol":
-		log.Printf("os identified is %s: ", strings.ToLower(getOS()))
+		log.Printf("os identified is %s: ", strings.ToLower(osID))
 		cmd := []string{"adduser", "-m", "--home-dir", home, username}
-		return cmd
+		return cmd, nil
 	default:
-		log.Fatalf("the os %s is not handled", getOS())
+		return nil, fmt.Errorf("the os %s is not handled", osID)
 	}
-	return []string{}
 }
 
 func createUser(username string) (*SystemUser, error) {
@@ -267,15 +287,18 @@ func createUser(username string) (*SystemUser, error) {
 	home := path.Join("/home", username)
 	if !userAlreadyCreated {
 		log.Printf("the user %s is missing, creating it", username)
-		cmdList := getAdduserCommand(home, username)
+		cmdList, err := getAdduserCommand(home, username)
+		if err != nil {
+			return nil, err
+		}
 		cmd := exec.Command(cmdList[0], cmdList[1:]...)
 		log.Println("executing command: ", cmd.String())
 		var output bytes.Buffer
 		cmd.Stdout = &output
-		err := cmd.Run()
+		err = planner.Run(cmd)
 		log.Println(output.String())
 		if err != nil {
-			log.Fatalf("error while executing command adduser: %v", err)
+			return nil, fmt.Errorf("error while executing command adduser: %w", err)
 		}
 	}
 	// create sudoer file for user
@@ -284,20 +307,30 @@ func createUser(username string) (*SystemUser, error) {
 	if !fileExists(sudoerPathname) {
 		log.Printf("the sudoer file %s is missing, creating it", sudoerPathname)
 		sudoerContent := []byte(fmt.Sprintf("%s ALL=(ALL) NOPASSWD:ALL", username))
-		err := ioutil.WriteFile(sudoerPathname, sudoerContent, 0644)
+		err := planner.Do("write "+sudoerPathname, func() error {
+			return ioutil.WriteFile(sudoerPathname, sudoerContent, 0644)
+		})
 		if err != nil {
-			log.Fatal("error while  writing sudoer configuration")
+			return nil, fmt.Errorf("error while writing sudoer configuration: %w", err)
 		}
 	}
 	// create sshdir
 	homeUserSSH := path.Join(home, ".ssh")
-	uid, gid := GetUidGid(username)
+	uid, gid, err := GetUidGid(username)
+	if err != nil && !planner.DryRun() {
+		return nil, err
+	}
 	sshDir := path.Join(homeUserSSH)
 	ok, _ := exists(sshDir)
 	if !ok {
 		log.Printf("the %s is missing, creating it", sshDir)
-		os.Mkdir(sshDir, 0755)
-		os.Chown(sshDir, uid, gid)
+		err := planner.Do("create directory "+sshDir, func() error {
+			os.Mkdir(sshDir, 0755)
+			return os.Chown(sshDir, uid, gid)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create %s: %w", sshDir, err)
+		}
 	}
 
 	userSpec.Name = username
@@ -1,14 +1,73 @@
 package component
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func TestsshPubKeys(t *testing.T) {
+func TestSSHKeysFromBucket(t *testing.T) {
+	localDir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+	tempDir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	spec := "users:\n  - name: alice\n    user_id: alice\n"
+	if err := ioutil.WriteFile(filepath.Join(localDir, SSHUserSpecs), []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ssh-ed25519 AAAA %s\n", strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".keys"))
+	}))
+	defer server.Close()
+
 	setting := SSHConfig{
-		TempDir:              "/tmp/.ssh",
-		UserDir:              "/tmp/user",
-		DefaultSShPubKeyFile: "ssh/pub_key",
+		TempDir:         tempDir,
+		LocalDirConfigs: localDir,
+		Adapter:         HTTPAdapterSet{Name: "http", Uri: server.URL},
+	}
+	ssh := SSHComponent{newTestComponentData(t, &ClusterConfig{SSH: setting})}
+	if err := ssh.Init(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := ssh.DownloadFilesToDirectory(ssh.getFiles(), tempDir, SSHBucketDir, false); err != nil {
+		t.Fatal(err)
+	}
+	sshYaml, err := unmarshalSSHUserYaml(tempDir, setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, errorFound, err := getKeysFromAdapter(setting, sshYaml)
+	if err != nil || errorFound {
+		t.Fatalf("unexpected error getting keys: %v", err)
+	}
+	if !strings.Contains(keys.String(), "ssh-ed25519 AAAA alice") {
+		t.Fatalf("unexpected authorized_keys content: %q", keys.String())
+	}
+}
+
+func TestGetUidGid(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, gid, err := GetUidGid(current.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(uid) != current.Uid || strconv.Itoa(gid) != current.Gid {
+		t.Fatalf("got %d:%d, expected %s:%s", uid, gid, current.Uid, current.Gid)
 	}
-	sshPubKeys(setting)
 }
@@ -15,14 +15,12 @@
 package pki
 
 import (
-	"log"
-
 	"k8s.io/kubernetes/cmd/kubeadm/app/apis/kubeadm"
 	"k8s.io/kubernetes/cmd/kubeadm/app/phases/certs"
 )
 
 // NewPKI generates new
-func NewPKI() {
+func NewPKI() error {
 	cfg := &kubeadm.InitConfiguration{
 		APIEndpoint: kubeadm.APIEndpoint{
 			AdvertiseAddress: "1.1.1.1",
@@ -49,8 +47,5 @@ func NewPKI() {
 			},
 		},
 	}
-	err := certs.CreatePKIAssets(cfg)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return certs.CreatePKIAssets(cfg)
 }
@@ -0,0 +1,60 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Planner performs the actions changing the bucket or the node, or only prints them in dry-run mode
+type Planner struct {
+	DryRun bool
+	Out    io.Writer
+}
+
+// Default is the planner used by furyagent, the --dry-run flag enables its dry-run mode
+var Default = &Planner{Out: os.Stdout}
+
+// Do runs action, described by description, unless the planner is in dry-run mode
+func (p *Planner) Do(description string, action func() error) error {
+	if p.DryRun {
+		fmt.Fprintf(p.Out, "[dry-run] would %s\n", description)
+		return nil
+	}
+	return action()
+}
+
+// Run runs cmd unless the planner is in dry-run mode
+func (p *Planner) Run(cmd *exec.Cmd) error {
+	return p.Do("run "+cmd.String(), cmd.Run)
+}
+
+// Do runs action with the Default planner
+func Do(description string, action func() error) error {
+	return Default.Do(description, action)
+}
+
+// Run runs cmd with the Default planner
+func Run(cmd *exec.Cmd) error {
+	return Default.Run(cmd)
+}
+
+// DryRun reports whether the Default planner is in dry-run mode
+func DryRun() bool {
+	return Default.DryRun
+}
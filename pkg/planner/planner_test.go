@@ -0,0 +1,39 @@
+package planner
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPlannerDryRun(t *testing.T) {
+	out := new(bytes.Buffer)
+	p := &Planner{DryRun: true, Out: out}
+	called := false
+	if err := p.Do("remove pki/master/ca.crt", func() error { called = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Run(exec.Command("adduser", "sighup")); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("action performed in dry-run mode")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != "[dry-run] would remove pki/master/ca.crt" || !strings.HasSuffix(lines[1], "adduser sighup") {
+		t.Fatalf("unexpected plan:\n%s", out.String())
+	}
+}
+
+func TestPlannerRun(t *testing.T) {
+	out := new(bytes.Buffer)
+	p := &Planner{Out: out}
+	called := false
+	if err := p.Do("remove pki/master/ca.crt", func() error { called = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !called || out.Len() != 0 {
+		t.Fatalf("action not performed, or printed: %q", out.String())
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by a Backend when the requested object does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when an upload would replace an object that must be kept
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrPermission is returned when the credentials cannot access an object. It is
+	// os.ErrPermission, so a denied local file matches it as well.
+	ErrPermission = os.ErrPermission
+)
+
+// ObjectInfo describes an object stored in a Backend
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// Backend is the set of operations Data needs from an object storage.
+// Object names are always slash separated paths relative to the bucket root.
+type Backend interface {
+	// Get opens the named object for reading, the caller must close it
+	Get(name string) (io.ReadCloser, error)
+	// Put creates or replaces the named object with size bytes read from r
+	Put(name string, r io.Reader, size int64, metadata map[string]string) error
+	// List returns the names of all the objects starting with prefix
+	List(prefix string) ([]string, error)
+	// Delete removes the named object
+	Delete(name string) error
+	// Stat returns the information about the named object without reading it
+	Stat(name string) (*ObjectInfo, error)
+	// Close releases the resources held by the backend
+	Close() error
+}
+
+// newBackend picks the Backend implementation from the configured provider
+func newBackend(cfg *Config) (Backend, error) {
+	if len(cfg.Replicas) > 0 {
+		r, err := newReplicatedBackend(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if r.multipart {
+			return &replicatedMultipartBackend{r}, nil
+		}
+		return r, nil
+	}
+	switch cfg.Provider {
+	case "s3":
+		return newS3Backend(cfg)
+	case "azure", "google", "local":
+		return newStowBackend(cfg)
+	case "vault":
+		return newVaultBackend(cfg)
+	case "memory":
+		return NewMemoryBackend(), nil
+	default:
+		return nil, fmt.Errorf("provider \"%s\" not supported", cfg.Provider)
+	}
+}
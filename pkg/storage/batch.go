@@ -0,0 +1,114 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultConcurrency is the number of transfers of a batch run in parallel when storage.concurrency is not set
+const DefaultConcurrency = 8
+
+// BatchError collects the errors of the files of a batch transfer that failed
+type BatchError struct {
+	Errors map[string]error
+}
+
+// Error lists the failed files in alphabetical order
+func (e *BatchError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("%s: %v", name, e.Errors[name])
+	}
+	return fmt.Sprintf("%d of the transfers failed: %s", len(names), strings.Join(messages, "; "))
+}
+
+// Is reports whether the error of any file is target, so that errors.Is(err, ErrNotFound) keeps working
+func (e *BatchError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// batch runs transfer for every name, at most s.concurrency at a time, and
+// returns a BatchError with the names that failed
+func (s *Data) batch(names []string, transfer func(name string) error) error {
+	concurrency := s.concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	var mu sync.Mutex
+	failed := map[string]error{}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for _, name := range names {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := transfer(name); err != nil {
+				mu.Lock()
+				failed[name] = err
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return &BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// keyedMutex serializes the updates of the same manifest by the transfers of a batch
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: map[string]*sync.Mutex{}}
+}
+
+// lock locks key and returns the function unlocking it
+func (k *keyedMutex) lock(key string) func() {
+	if k == nil {
+		return func() {}
+	}
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = new(sync.Mutex)
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
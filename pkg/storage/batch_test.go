@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowBackend records how many reads run at the same time
+type slowBackend struct {
+	*MemoryBackend
+	mu       sync.Mutex
+	running  int
+	parallel int
+}
+
+func (b *slowBackend) Get(name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	b.running++
+	if b.running > b.parallel {
+		b.parallel = b.running
+	}
+	b.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	b.mu.Lock()
+	b.running--
+	b.mu.Unlock()
+	return b.MemoryBackend.Get(name)
+}
+
+func TestBatchTransfers(t *testing.T) {
+	backend := &slowBackend{MemoryBackend: NewMemoryBackend()}
+	store, err := NewData(backend, &Config{Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("client-%02d.crt", i)
+		files[name] = []byte(name)
+		names = append(names, name)
+	}
+	if err := store.UploadFilesFromMemory(files, "pki/vpn-client"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := store.Manifest("pki/vpn-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != len(files) {
+		t.Fatalf("the manifest lists %d files, expected %d", len(manifest.Files), len(files))
+	}
+
+	backend.parallel = 0
+	downloaded, err := store.DownloadFilesToMemory(names, "pki/vpn-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if string(downloaded[name]) != string(content) {
+			t.Fatalf("%s downloaded as %q", name, downloaded[name])
+		}
+	}
+	if backend.parallel < 2 || backend.parallel > 4 {
+		t.Fatalf("%d downloads ran in parallel, expected between 2 and 4", backend.parallel)
+	}
+
+	_, err = store.DownloadFilesToMemory(append(names, "missing-1.crt", "missing-2.crt"), "pki/vpn-client")
+	batchErr, ok := err.(*BatchError)
+	if !ok || len(batchErr.Errors) != 2 || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(err.Error(), "missing-1.crt: ") || strings.Index(err.Error(), "missing-1") > strings.Index(err.Error(), "missing-2") {
+		t.Fatalf("unexpected message: %v", err)
+	}
+
+	files["client-00.crt"], files["new.crt"] = []byte("replaced"), []byte("new")
+	err = store.UploadFilesFromMemory(files, "pki/vpn-client")
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	if strings.Count(err.Error(), "client-00.crt") != 1 {
+		t.Fatalf("file named more than once: %v", err)
+	}
+	if store.Exists("pki/vpn-client/new.crt") {
+		t.Fatal("new.crt uploaded although other files exist already")
+	}
+}
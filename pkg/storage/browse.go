@@ -0,0 +1,93 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Entry is an object, or a directory when Dir is true, found browsing the bucket
+type Entry struct {
+	Name         string
+	Dir          bool
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// Stat returns the information about an object of the bucket
+func (s *Data) Stat(filename string) (*ObjectInfo, error) {
+	return s.backend.Stat(filename)
+}
+
+// Browse lists the objects below prefix with their size. Unless recursive is set,
+// the objects of the subdirectories are grouped in a directory entry with their total size.
+func (s *Data) Browse(prefix string, recursive bool) ([]Entry, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		// a single object or a directory
+		if info, err := s.backend.Stat(prefix); err == nil {
+			return []Entry{{Name: info.Name, Size: info.Size, LastModified: info.LastModified, Metadata: info.Metadata}}, nil
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+		prefix += "/"
+	}
+	names, err := s.backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	dirs := map[string]int{}
+	for _, name := range names {
+		if isLock(name) {
+			continue
+		}
+		info, err := s.backend.Stat(name)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot stat %s: %w", name, err)
+		}
+		if i := strings.Index(strings.TrimPrefix(name, prefix), "/"); !recursive && i >= 0 {
+			dir := name[:len(prefix)+i+1]
+			n, ok := dirs[dir]
+			if !ok {
+				n = len(entries)
+				dirs[dir] = n
+				entries = append(entries, Entry{Name: dir, Dir: true})
+			}
+			entries[n].Size += info.Size
+			if info.LastModified.After(entries[n].LastModified) {
+				entries[n].LastModified = info.LastModified
+			}
+			continue
+		}
+		entries = append(entries, Entry{Name: name, Size: info.Size, LastModified: info.LastModified, Metadata: info.Metadata})
+	}
+	return entries, nil
+}
+
+// Copy copies the object src to dest, which must not exist
+func (s *Data) Copy(src, dest string) error {
+	if s.Exists(dest) {
+		return fmt.Errorf("%s %w", dest, ErrAlreadyExists)
+	}
+	buffer := bufferWriteCloser{new(bytes.Buffer)}
+	if err := s.Download(src, buffer); err != nil {
+		return err
+	}
+	return s.put(dest, bytes.NewReader(buffer.Buf.Bytes()), int64(buffer.Buf.Len()))
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestBrowseAndCopy(t *testing.T) {
+	store, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"snapshot.db": []byte("0123456789")}
+	if err := store.UploadFilesFromMemory(files, "etcd/node-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Copy("etcd/node-1/snapshot.db", "etcd/node-2/snapshot.db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Copy("etcd/node-1/snapshot.db", "etcd/node-2/snapshot.db"); err == nil {
+		t.Fatal("copy must not overwrite an existing object")
+	}
+
+	entries, err := store.Browse("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "etcd/" || !entries[0].Dir {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries, err = store.Browse("etcd", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if len(names) != 4 || names[1] != "etcd/node-1/snapshot.db" || names[3] != "etcd/node-2/snapshot.db" {
+		t.Fatalf("unexpected recursive listing %v", names)
+	}
+	entries, err = store.Browse("etcd/node-2/snapshot.db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Size != 10 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+func TestListSkipsLocks(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadFilesFromMemory(map[string][]byte{"alice.crt": []byte("cert")}, "pki/vpn-client"); err != nil {
+		t.Fatal(err)
+	}
+	// left behind by an interrupted update
+	if err := backend.Put("pki/vpn-client/alice.crt"+lockSuffix, nopReadCloser("{}"), 2, nil); err != nil {
+		t.Fatal(err)
+	}
+	names, err := store.List("pki/vpn-client/")
+	if err != nil || len(names) != 1 || names[0] != "alice.crt" {
+		t.Fatalf("unexpected list %v (%v)", names, err)
+	}
+	entries, err := store.Browse("pki/vpn-client/", true)
+	if err != nil || len(entries) != 2 || entries[1].Name != "pki/vpn-client/alice.crt" {
+		t.Fatalf("unexpected entries %+v (%v)", entries, err)
+	}
+}
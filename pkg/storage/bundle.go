@@ -0,0 +1,258 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundleManifestFile is the manifest at the root of a bundle
+const BundleManifestFile = "bundle.json"
+
+// BundlePrefixes are the directories of the bucket always exported in a bundle
+var BundlePrefixes = []string{"pki/", "ssh/", "join/"}
+
+// bundleEtcdPrefix holds the etcd snapshots exported in a bundle next to BundlePrefixes
+const bundleEtcdPrefix = "etcd/"
+
+// validBundleName reports whether name can be imported from a bundle: a clean relative
+// path below BundlePrefixes or the etcd snapshots, which is not an internal object
+func validBundleName(name string) bool {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || isManifest(name) || isLock(name) {
+		return false
+	}
+	for _, prefix := range append([]string{bundleEtcdPrefix}, BundlePrefixes...) {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// BundleManifest describes the content of a bundle, every file is checked against it on import
+type BundleManifest struct {
+	Created  time.Time                `json:"created"`
+	Hostname string                   `json:"hostname"`
+	Files    map[string]ManifestEntry `json:"files"`
+}
+
+// Names returns the files of the bundle in alphabetical order
+func (m *BundleManifest) Names() []string {
+	names := make([]string, 0, len(m.Files))
+	for name := range m.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExportBundle writes to w a zip archive of the objects below prefixes and of objects,
+// together with their BundleManifest, encrypted with passphrase. The manifests of the
+// directories, the history and the locks are left out.
+func (s *Data) ExportBundle(w io.Writer, passphrase string, prefixes []string, objects ...string) (*BundleManifest, error) {
+	envelope, err := bundleEnvelope(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "furyagent-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	hostname, _ := os.Hostname()
+	manifest := &BundleManifest{Created: time.Now().UTC(), Hostname: hostname, Files: map[string]ManifestEntry{}}
+	names := append([]string{}, objects...)
+	for _, prefix := range prefixes {
+		found, err := s.backend.List(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list %s: %w", prefix, err)
+		}
+		names = append(names, found...)
+	}
+	for _, name := range names {
+		if isManifest(name) || isLock(name) {
+			continue
+		}
+		// the name becomes a path below dir
+		if !validBundleName(name) {
+			return nil, fmt.Errorf("Cannot export %q: it is not below %s or %s", name, strings.Join(BundlePrefixes, ", "), bundleEtcdPrefix)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		digest := newDigester()
+		err = s.Download(name, teeWriteCloser{io.MultiWriter(f, digest), f})
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot export %s: %w", name, err)
+		}
+		manifest.Files[name] = *digest.entry()
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, BundleManifestFile), content, 0600); err != nil {
+		return nil, err
+	}
+
+	archive, err := ioutil.TempFile("", "furyagent-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	if err := writeZip(archive, dir, append([]string{BundleManifestFile}, manifest.Names()...)...); err != nil {
+		return nil, fmt.Errorf("Cannot write the bundle: %w", err)
+	}
+	size, err := archive.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	sealed, _, err := envelope.seal(archive, size)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, sealed); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ImportBundle uploads the content of a bundle written by ExportBundle. Every file is
+// checked against the bundle manifest before anything is uploaded; the objects already
+// in the bucket are replaced only with overwrite.
+func (s *Data) ImportBundle(r io.Reader, passphrase string, overwrite bool) (*BundleManifest, error) {
+	envelope, err := bundleEnvelope(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(encryptionMagic)); err != nil || string(magic) != encryptionMagic {
+		return nil, errors.New("not an encrypted furyagent bundle")
+	}
+	plain, err := envelope.open(br)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := ioutil.TempFile("", "furyagent-bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+	size, err := io.Copy(archive, plain)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt the bundle: %v", err)
+	}
+	zr, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	manifest := new(BundleManifest)
+	if err := readZipJSON(files[BundleManifestFile], manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", BundleManifestFile, err)
+	}
+
+	names := manifest.Names()
+	for _, name := range names {
+		if !validBundleName(name) {
+			return nil, fmt.Errorf("invalid bundle: %q is not below %s or %s", name, strings.Join(BundlePrefixes, ", "), bundleEtcdPrefix)
+		}
+	}
+	err = s.batch(names, func(name string) error {
+		f, ok := files[name]
+		if !ok {
+			return errors.New("missing from the bundle")
+		}
+		digest := newDigester()
+		if err := copyZipFile(f, digest); err != nil {
+			return err
+		}
+		if entry := manifest.Files[name]; entry.SHA256 != digest.sum() || entry.Size != digest.size {
+			return fmt.Errorf("integrity check failed: expected sha256 %s (%d bytes), got %s (%d bytes)", entry.SHA256, entry.Size, digest.sum(), digest.size)
+		}
+		if !overwrite && s.Exists(name) {
+			return ErrAlreadyExists
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.batch(names, func(name string) error {
+		rc, err := files[name].Open()
+		if err != nil {
+			return err
+		}
+		return s.UploadForce(name, manifest.Files[name].Size, rc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func bundleEnvelope(passphrase string) (*envelope, error) {
+	if passphrase == "" {
+		return nil, errors.New("a bundle needs a passphrase")
+	}
+	return newEnvelope(EncryptionConfig{Passphrase: passphrase})
+}
+
+func copyZipFile(f *zip.File, w io.Writer) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	if f == nil {
+		return errors.New("missing from the bundle")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestBundleExportImport(t *testing.T) {
+	src, err := NewData(NewMemoryBackend(), &Config{Encryption: EncryptionConfig{Passphrase: "bucket secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dir, files := range map[string]map[string][]byte{
+		"pki/master":     {"ca.crt": []byte("crt"), "ca.key": []byte("key")},
+		"ssh":            {"ssh-users.yml": []byte("users: []")},
+		"join":           {"join.sh": []byte("kubeadm join")},
+		"etcd/etcd-1":    {"snapshot.db": []byte("snapshot")},
+		"somewhere/else": {"file": []byte("not exported")},
+	} {
+		if err := src.UploadFilesFromMemory(files, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.UploadForce("pki/master/ca.crt", 7, nopReadCloser("new crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := new(bytes.Buffer)
+	manifest, err := src.ExportBundle(bundle, "escrow", BundlePrefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"join/join.sh", "pki/master/ca.crt", "pki/master/ca.key", "ssh/ssh-users.yml"}
+	if names := manifest.Names(); len(names) != len(expected) {
+		t.Fatalf("exported %v, expected %v", names, expected)
+	}
+	if bytes.Contains(bundle.Bytes(), []byte("kubeadm join")) {
+		t.Fatal("the bundle is not encrypted")
+	}
+
+	dst, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle.Bytes()), "wrong", false); err == nil {
+		t.Fatal("bundle imported with a wrong passphrase")
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle.Bytes()), "escrow", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range expected {
+		original, _, err := src.sha256Of(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, _, err := dst.sha256Of(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if original != imported {
+			t.Fatalf("%s imported with a different content", name)
+		}
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle.Bytes()), "escrow", false); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists, got %v", err)
+	}
+	if _, err := dst.ImportBundle(bytes.NewReader(bundle.Bytes()), "escrow", true); err != nil {
+		t.Fatal(err)
+	}
+
+	withEtcd := new(bytes.Buffer)
+	manifest, err = src.ExportBundle(withEtcd, "escrow", BundlePrefixes, "etcd/etcd-1/snapshot.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifest.Files["etcd/etcd-1/snapshot.db"]; !ok {
+		t.Fatalf("etcd snapshot not exported: %v", manifest.Names())
+	}
+}
+
+// forgeBundle returns a bundle holding files, with a matching manifest
+func forgeBundle(t *testing.T, files map[string]string) []byte {
+	archive := new(bytes.Buffer)
+	zw := zip.NewWriter(archive)
+	manifest := &BundleManifest{Files: map[string]ManifestEntry{}}
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		digest := newDigester()
+		digest.Write([]byte(content))
+		manifest.Files[name] = *digest.entry()
+	}
+	w, err := zw.Create(BundleManifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewEncoder(w).Encode(manifest)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := bundleEnvelope("escrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _, err := envelope.seal(archive, int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := ioutil.ReadAll(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bundle
+}
+
+func TestImportBundleRejectsForeignNames(t *testing.T) {
+	for _, name := range []string{"pki/../../etc/cron.d/job", "somewhere/else", "/pki/master/ca.key", "pki/master/MANIFEST.json"} {
+		backend := NewMemoryBackend()
+		store, err := NewData(backend, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle := forgeBundle(t, map[string]string{"pki/master/ca.crt": "crt", name: "x"})
+		if _, err := store.ImportBundle(bytes.NewReader(bundle), "escrow", false); err == nil {
+			t.Fatalf("%s imported", name)
+		}
+		if names, _ := backend.List(""); len(names) != 0 {
+			t.Fatalf("%s: objects imported from an invalid bundle: %v", name, names)
+		}
+		// the manifests are skipped by the export
+		if _, err := store.ExportBundle(new(bytes.Buffer), "escrow", nil, name); err == nil && !isManifest(name) {
+			t.Fatalf("%s exported", name)
+		}
+	}
+	valid := forgeBundle(t, map[string]string{"pki/master/ca.crt": "crt", "etcd/etcd-1/snapshot.db": "snapshot"})
+	store, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ImportBundle(bytes.NewReader(valid), "escrow", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CacheConfig configures the local copy of the downloaded objects, off unless Enabled
+type CacheConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Dir defaults to furyagent in the user cache directory (e.g. ~/.cache/furyagent)
+	Dir string `mapstructure:"dir"`
+	// Disabled overrides Enabled, it is set by --no-cache
+	Disabled bool `mapstructure:"disabled"`
+}
+
+// uncachedPrefixes hold private keys, join tokens and etcd snapshots, cached only when encrypted
+var uncachedPrefixes = []string{"pki/", "etcd/", "join/"}
+
+// cache keeps the downloaded objects on disk, as they are stored in the bucket
+// (so still encrypted when encryption is configured), keyed by object name and ETag.
+// An object is downloaded again only when its ETag changes.
+type cache struct {
+	dir string
+}
+
+// DefaultCacheDir returns the cache directory used when cache.dir is not configured
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "furyagent"), nil
+}
+
+func newCache(cfg *Config) *cache {
+	if cfg.Cache.Disabled || cfg.Cache.Dir == "" {
+		return nil
+	}
+	return &cache{dir: filepath.Join(cfg.Cache.Dir, cacheNamespace(cfg))}
+}
+
+// cacheNamespace identifies the bucket of cfg, so that two buckets never share their entries
+func cacheNamespace(cfg *Config) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s\x00%s",
+		cfg.Provider, cfg.URL, cfg.BucketName, cfg.LocalPath, cfg.AzureStorageAccount,
+		cfg.Vault.Address, cfg.Vault.Namespace, cfg.Vault.Mount+"/"+cfg.Vault.Path, cfg.ClusterName)
+	for i := range cfg.Replicas {
+		fmt.Fprintf(h, "\x00%s", cacheNamespace(&cfg.Replicas[i]))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16]
+}
+
+// cacheFor returns the cache of filename, nil if it must not be stored in clear on disk
+func (s *Data) cacheFor(filename string) *cache {
+	if s.envelope == nil {
+		for _, prefix := range uncachedPrefixes {
+			if strings.HasPrefix(filename, prefix) {
+				return nil
+			}
+		}
+	}
+	return s.cache
+}
+
+// entry returns the directory of the versions of name and the file of version etag
+func (c *cache) entry(name, etag string) (string, string) {
+	dir := filepath.Join(c.dir, fmt.Sprintf("%x", sha256.Sum256([]byte(name))))
+	return dir, filepath.Join(dir, fmt.Sprintf("%x", sha256.Sum256([]byte(etag))))
+}
+
+// get opens the cached content of name at version etag, nil if it is not cached
+func (c *cache) get(name, etag string) io.ReadCloser {
+	if c == nil || etag == "" {
+		return nil
+	}
+	_, file := c.entry(name, etag)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	// the modification time tells prune when the entry was used last
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return f
+}
+
+// fill returns r, copying it to the cache as name at version etag once all of its size bytes are read
+func (c *cache) fill(name, etag string, size int64, r io.ReadCloser) io.ReadCloser {
+	if c == nil || etag == "" {
+		return r
+	}
+	dir, file := c.entry(name, etag)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return r
+	}
+	tmp, err := ioutil.TempFile(dir, ".fill")
+	if err != nil {
+		return r
+	}
+	return &cacheFiller{ReadCloser: r, tmp: tmp, dir: dir, file: file, size: size}
+}
+
+// cacheFiller copies what is read to tmp and moves it in place of the other versions on Close
+type cacheFiller struct {
+	io.ReadCloser
+	tmp       *os.File
+	dir, file string
+	size, n   int64
+	failed    bool
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.tmp.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+		f.n += int64(n)
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.ReadCloser.Close()
+	f.tmp.Close()
+	if f.failed || f.n != f.size || os.Rename(f.tmp.Name(), f.file) != nil {
+		os.Remove(f.tmp.Name())
+		return err
+	}
+	// the older versions of the object are not needed anymore
+	versions, _ := filepath.Glob(filepath.Join(f.dir, "*"))
+	for _, version := range versions {
+		if version != f.file {
+			os.Remove(version)
+		}
+	}
+	return err
+}
+
+// PruneCache removes the entries of the cache in dir not used in the last maxAge,
+// all of them if maxAge is 0, and returns how many were removed and their size
+func PruneCache(dir string, maxAge time.Duration) (int, int64, error) {
+	var removed int
+	var freed int64
+	limit := time.Now().Add(-maxAge)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || (maxAge > 0 && info.ModTime().After(limit)) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return removed, freed, err
+	}
+	// drop the directories left empty, deepest first
+	var dirs []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != dir {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// countingBackend counts the reads of ssh/ssh-users.yml from the bucket
+type countingBackend struct {
+	*MemoryBackend
+	gets int
+}
+
+func (c *countingBackend) Get(name string) (io.ReadCloser, error) {
+	if name == "ssh/ssh-users.yml" {
+		c.gets++
+	}
+	return c.MemoryBackend.Get(name)
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "furyagent-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	cfg := &Config{Cache: CacheConfig{Dir: dir}, Encryption: EncryptionConfig{Passphrase: "secret"}}
+	store, err := NewData(backend, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func(expected string) {
+		t.Helper()
+		buffer := bufferWriteCloser{new(bytes.Buffer)}
+		if err := store.Download("ssh/ssh-users.yml", buffer); err != nil {
+			t.Fatal(err)
+		}
+		if buffer.Buf.String() != expected {
+			t.Fatalf("downloaded %q, expected %q", buffer.Buf.String(), expected)
+		}
+	}
+	if err := store.UploadForce("ssh/ssh-users.yml", 5, nopReadCloser("users")); err != nil {
+		t.Fatal(err)
+	}
+	download("users")
+	download("users")
+	if backend.gets != 1 {
+		t.Fatalf("unchanged object read %d times from the bucket", backend.gets)
+	}
+	if err := store.UploadForce("ssh/ssh-users.yml", 7, nopReadCloser("changed")); err != nil {
+		t.Fatal(err)
+	}
+	download("changed")
+	download("changed")
+	if backend.gets != 2 {
+		t.Fatalf("changed object read %d times from the bucket", backend.gets)
+	}
+
+	uncached, err := NewData(backend, &Config{Cache: CacheConfig{Dir: dir, Disabled: true}, Encryption: cfg.Encryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := uncached.Download("ssh/ssh-users.yml", bufferWriteCloser{new(bytes.Buffer)}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.gets != 3 {
+		t.Fatal("object read from the cache with the cache disabled")
+	}
+
+	removed, _, err := PruneCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last versions of the object and of the manifest of ssh/
+	if removed != 2 {
+		t.Fatalf("%d entries pruned, expected 2", removed)
+	}
+	download("changed")
+	if backend.gets != 4 {
+		t.Fatal("object read from a pruned cache")
+	}
+}
+
+func TestCacheSkipsSecretsInClear(t *testing.T) {
+	dir, err := ioutil.TempDir("", "furyagent-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewData(NewMemoryBackend(), &Config{Cache: CacheConfig{Dir: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pki/master/ca.key", "etcd/snapshot.db", "ssh/ssh-users.yml"} {
+		if err := store.UploadForce(name, 3, nopReadCloser("key")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Download(name, bufferWriteCloser{new(bytes.Buffer)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, cached := range map[string]bool{"pki/master/ca.key": false, "etcd/snapshot.db": false, "ssh/ssh-users.yml": true} {
+		info, err := store.backend.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader := store.cache.get(name, info.ETag); (reader != nil) != cached {
+			t.Fatalf("%s cached: %v, expected %v", name, reader != nil, cached)
+		} else if reader != nil {
+			reader.Close()
+		}
+	}
+}
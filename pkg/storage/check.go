@@ -0,0 +1,140 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+// checkPrefix is the directory of the probe objects written by Check
+const checkPrefix = ".furyagent-check/"
+
+// errSkipped is the error of the steps of Check depending on a failed one
+var errSkipped = errors.New("skipped, the probe could not be written")
+
+// errNotWritten is the error of the steps of Check needing the probe in dry-run mode
+var errNotWritten = errors.New("skipped, the probe is not written in dry-run mode")
+
+// CheckStep is the outcome of a capability tested by Check
+type CheckStep struct {
+	// Name is write, read, list or delete
+	Name    string
+	Latency time.Duration
+	Err     error
+	// Planned is set in dry-run mode on the steps changing the bucket, which are not run
+	Planned bool
+}
+
+// Passed reports whether the capability works
+func (c CheckStep) Passed() bool {
+	return c.Err == nil
+}
+
+// Skipped reports whether the step was not run, in dry-run mode
+func (c CheckStep) Skipped() bool {
+	return c.Err == errNotWritten
+}
+
+// Check tests the credentials against the bucket: it writes a probe object, reads it
+// back comparing the bytes, lists its directory and deletes it. Every capability is
+// tested even if another one fails, except the ones needing the probe. In dry-run mode
+// the write and the delete are only planned, and only the list is tested.
+func (s *Data) Check() []CheckStep {
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	probe := fmt.Sprintf("%s%s-%x", checkPrefix, hostname, suffix)
+	content := make([]byte, 1024)
+	rand.Read(content)
+
+	var steps []CheckStep
+	step := func(name string, test func() error) error {
+		start := time.Now()
+		err := test()
+		steps = append(steps, CheckStep{Name: name, Latency: time.Since(start), Err: err})
+		return err
+	}
+	skip := func(name string) {
+		steps = append(steps, CheckStep{Name: name, Err: errSkipped})
+	}
+	if planner.DryRun() {
+		planner.Do("write the probe "+probe, nil)
+		steps = append(steps, CheckStep{Name: "write", Planned: true}, CheckStep{Name: "read", Err: errNotWritten})
+		step("list", func() error {
+			_, err := s.backend.List(checkPrefix)
+			return err
+		})
+		planner.Do("delete the probe "+probe, nil)
+		return append(steps, CheckStep{Name: "delete", Planned: true})
+	}
+
+	written := step("write", func() error {
+		return s.backend.Put(probe, bytes.NewReader(content), int64(len(content)), nil)
+	}) == nil
+	if written {
+		step("read", func() error {
+			r, err := s.backend.Get(probe)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			read, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(read, content) {
+				return fmt.Errorf("%s read back with a different content (%d bytes instead of %d)", probe, len(read), len(content))
+			}
+			return nil
+		})
+	} else {
+		skip("read")
+	}
+	step("list", func() error {
+		names, err := s.backend.List(checkPrefix)
+		if err != nil || !written {
+			return err
+		}
+		for _, name := range names {
+			if name == probe {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s missing from the list of %s", path.Base(probe), checkPrefix)
+	})
+	if written {
+		step("delete", func() error {
+			if err := s.backend.Delete(probe); err != nil {
+				return err
+			}
+			if _, err := s.backend.Stat(probe); err != ErrNotFound {
+				return fmt.Errorf("%s still there after deleting it", probe)
+			}
+			return nil
+		})
+	} else {
+		skip("delete")
+	}
+	return steps
+}
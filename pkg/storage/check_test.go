@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+func TestCheck(t *testing.T) {
+	backend := &unreachableBackend{MemoryBackend: NewMemoryBackend()}
+	store, err := NewData(backend, &Config{ClusterName: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := store.Check()
+	if len(steps) != 4 {
+		t.Fatalf("%d steps, expected 4", len(steps))
+	}
+	for i, name := range []string{"write", "read", "list", "delete"} {
+		if steps[i].Name != name || !steps[i].Passed() {
+			t.Fatalf("step %d: %s failed: %v", i, steps[i].Name, steps[i].Err)
+		}
+	}
+	if names, _ := backend.List(""); len(names) != 0 {
+		t.Fatalf("the probe was left in the bucket: %v", names)
+	}
+
+	backend.down = true
+	steps = store.Check()
+	for _, step := range steps {
+		switch step.Name {
+		case "write":
+			if step.Err != errUnreachable {
+				t.Fatalf("unexpected write error: %v", step.Err)
+			}
+		case "list":
+			if !step.Passed() {
+				t.Fatalf("list failed: %v", step.Err)
+			}
+		default:
+			if step.Err != errSkipped {
+				t.Fatalf("%s not skipped: %v", step.Name, step.Err)
+			}
+		}
+	}
+}
+
+func TestCheckDryRun(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	defer func(p *planner.Planner) { planner.Default = p }(planner.Default)
+	planner.Default = &planner.Planner{DryRun: true, Out: out}
+
+	steps := store.Check()
+	if len(steps) != 4 || !steps[0].Planned || !steps[1].Skipped() || !steps[2].Passed() || !steps[3].Planned {
+		t.Fatalf("unexpected steps: %+v", steps)
+	}
+	if names, _ := backend.List(""); len(names) != 0 {
+		t.Fatalf("the probe was written in dry-run mode: %v", names)
+	}
+	if !strings.Contains(out.String(), "would write the probe") || !strings.Contains(out.String(), "would delete the probe") {
+		t.Fatalf("steps not reported as planned: %q", out.String())
+	}
+}
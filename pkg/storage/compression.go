@@ -0,0 +1,155 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// MetadataCompression is the object metadata holding the algorithm an object is compressed with
+	MetadataCompression = "compression"
+	// DefaultCompressionMinSizeKB is the smallest object compressed when minSizeKB is not configured
+	DefaultCompressionMinSizeKB = 1024
+
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// CompressionConfig enables the compression of the objects bigger than MinSizeKB
+type CompressionConfig struct {
+	// Algorithm is gzip or zstd, empty disables the compression
+	Algorithm string `mapstructure:"algorithm"`
+	// Level is 1-9 for gzip and 1-22 for zstd, 0 is the default level of the algorithm
+	Level     int   `mapstructure:"level"`
+	MinSizeKB int64 `mapstructure:"minSizeKB"`
+}
+
+// compressor compresses the objects before they are encrypted
+type compressor struct {
+	algorithm string
+	level     int
+	minSize   int64
+}
+
+func newCompressor(cfg CompressionConfig) (*compressor, error) {
+	c := &compressor{algorithm: cfg.Algorithm, level: cfg.Level, minSize: cfg.MinSizeKB * 1024}
+	switch cfg.Algorithm {
+	case "":
+		return nil, nil
+	case compressionGzip:
+		if c.level == 0 {
+			c.level = gzip.DefaultCompression
+		} else if c.level < gzip.BestSpeed || c.level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip compression level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+		}
+	case compressionZstd:
+		if c.level < 0 || c.level > 22 {
+			return nil, fmt.Errorf("zstd compression level must be between 1 and 22")
+		}
+	default:
+		return nil, fmt.Errorf("compression algorithm \"%s\" not supported", cfg.Algorithm)
+	}
+	if cfg.MinSizeKB == 0 {
+		c.minSize = DefaultCompressionMinSizeKB * 1024
+	}
+	return c, nil
+}
+
+// applies reports whether an object of size bytes is compressed
+func (c *compressor) applies(size int64) bool {
+	return c != nil && size >= c.minSize
+}
+
+func (c *compressor) writer(w io.Writer) (io.WriteCloser, error) {
+	if c.algorithm == compressionGzip {
+		return gzip.NewWriterLevel(w, c.level)
+	}
+	level := zstd.SpeedDefault
+	if c.level > 0 {
+		level = zstd.EncoderLevelFromZstd(c.level)
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+}
+
+// compress returns r compressed and its size, kept in memory or in a temporary file
+// depending on size. The returned function releases the temporary file.
+func (c *compressor) compress(r io.Reader, size int64) (io.Reader, int64, func(), error) {
+	if size <= spoolMemoryLimit {
+		buf := new(bytes.Buffer)
+		if err := c.compressTo(buf, r); err != nil {
+			return nil, 0, nil, err
+		}
+		return buf, int64(buf.Len()), func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "furyagent-compress")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if err := c.compressTo(f, r); err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	compressedSize, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, compressedSize, cleanup, nil
+}
+
+func (c *compressor) compressTo(w io.Writer, r io.Reader) error {
+	cw, err := c.writer(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, r); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// decompress returns the content of r, compressed with algorithm
+func decompress(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("compression algorithm \"%s\" not supported", algorithm)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "furyagent-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := []byte(strings.Repeat("etcd snapshot ", 10000))
+
+	for _, cfg := range []*Config{
+		{Provider: "memory", Compression: CompressionConfig{Algorithm: "zstd", MinSizeKB: 1}},
+		{Provider: "memory", Compression: CompressionConfig{Algorithm: "gzip", Level: 9, MinSizeKB: 1}, Encryption: EncryptionConfig{Passphrase: "secret"}},
+		{Provider: "local", LocalPath: dir, Compression: CompressionConfig{Algorithm: "zstd", Level: 19, MinSizeKB: 1}},
+	} {
+		store, err := Init(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{"snapshot.db": snapshot, "ca.crt": []byte("small")}
+		if err := store.UploadFilesFromMemory(files, "etcd/node-1"); err != nil {
+			t.Fatal(err)
+		}
+		info, err := store.Stat("etcd/node-1/snapshot.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Metadata[MetadataCompression] != cfg.Compression.Algorithm || info.Size >= int64(len(snapshot))/10 {
+			t.Fatalf("%s: snapshot not compressed: %+v", cfg.Provider, info)
+		}
+		if info, _ := store.Stat("etcd/node-1/ca.crt"); info.Metadata[MetadataCompression] != "" {
+			t.Fatalf("%s: objects smaller than minSizeKB must not be compressed", cfg.Provider)
+		}
+		listed, err := store.List("etcd/node-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 2 {
+			t.Fatalf("%s: unexpected listing %v", cfg.Provider, listed)
+		}
+		downloaded, err := store.DownloadFilesToMemory([]string{"snapshot.db", "ca.crt"}, "etcd/node-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded["snapshot.db"], snapshot) || string(downloaded["ca.crt"]) != "small" {
+			t.Fatalf("%s: content changed by the compression", cfg.Provider)
+		}
+		if err := store.Remove("etcd/node-1/snapshot.db"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(dir + "/etcd/node-1/snapshot.db" + metadataSidecarSuffix); !os.IsNotExist(err) {
+		t.Fatal("the metadata of a removed object must be removed")
+	}
+
+	if _, err := newCompressor(CompressionConfig{Algorithm: "lz4"}); err == nil {
+		t.Fatal("unknown algorithms must be rejected")
+	}
+}
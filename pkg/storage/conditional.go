@@ -0,0 +1,222 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+const (
+	lockSuffix    = ".lock"
+	lockLease     = 30 * time.Second
+	updateRetries = 10
+)
+
+// ErrConflict is returned when an object changed since it was read
+var ErrConflict = errors.New("object was modified concurrently")
+
+// errNoConditionalWrite is returned by putIfMatch on the backends which cannot write an object only if it did not change
+var errNoConditionalWrite = errors.New("the provider has no conditional write, concurrent updates cannot be detected")
+
+// newConflictBackOff returns the retry policy of Update when a concurrent write is detected
+var newConflictBackOff = func() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 200 * time.Millisecond
+	return backoff.WithMaxRetries(b, updateRetries)
+}
+
+// ConditionalBackend is implemented by the backends able to replace an object
+// only if it did not change, like S3 If-Match or Vault check-and-set
+type ConditionalBackend interface {
+	Backend
+	// PutIfMatch is Put that fails with ErrConflict if the ETag of the object is not
+	// etag anymore. An empty etag means that the object must not exist.
+	PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error
+}
+
+// exclusiveCreator is implemented by the backends able to create an object only if it
+// does not exist yet, like the local provider with O_EXCL. It returns ErrAlreadyExists otherwise.
+type exclusiveCreator interface {
+	createExclusive(name string, content []byte) error
+}
+
+// isLock reports whether name is the lock object of another object
+func isLock(name string) bool {
+	return strings.HasSuffix(name, lockSuffix)
+}
+
+// lease is the content of the lock object used by the backends without conditional writes
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// putIfMatch replaces name only if its ETag is still etag. Backends without
+// conditional writes are serialized with a lock object holding a lease, created
+// exclusively: the other ones fail with errNoConditionalWrite.
+func putIfMatch(b Backend, name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	if cb, ok := b.(ConditionalBackend); ok {
+		return cb.PutIfMatch(name, r, size, metadata, etag)
+	}
+	return putWithLease(b, name, r, size, metadata, etag)
+}
+
+// putWithLease is putIfMatch holding the lease of the lock object of name
+func putWithLease(b Backend, name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	ec, ok := b.(exclusiveCreator)
+	if !ok {
+		return fmt.Errorf("Cannot update %s: %w", name, errNoConditionalWrite)
+	}
+	release, err := acquireLease(b, ec, name+lockSuffix)
+	if err != nil {
+		return err
+	}
+	defer release()
+	current := ""
+	info, err := b.Stat(name)
+	if err == nil {
+		current = info.ETag
+	} else if err != ErrNotFound {
+		return err
+	}
+	if current != etag {
+		return ErrConflict
+	}
+	return b.Put(name, r, size, metadata)
+}
+
+// acquireLease creates the lock object unless somebody else holds a valid lease on it
+func acquireLease(b Backend, ec exclusiveCreator, lockName string) (func(), error) {
+	held, err := readLease(b, lockName)
+	if err != nil {
+		return nil, err
+	} else if held != nil && time.Now().Before(held.Expires) {
+		return nil, ErrConflict
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	mine := lease{Owner: hex.EncodeToString(id), Expires: time.Now().Add(lockLease).UTC()}
+	content, err := json.Marshal(mine)
+	if err != nil {
+		return nil, err
+	}
+	if held != nil {
+		// the lease of a writer which did not release it expired
+		if err := b.Delete(lockName); err != nil && err != ErrNotFound {
+			return nil, fmt.Errorf("Cannot remove expired lock %s: %w", lockName, err)
+		}
+	}
+	if err := ec.createExclusive(lockName, content); err == ErrAlreadyExists {
+		return nil, ErrConflict
+	} else if err != nil {
+		return nil, fmt.Errorf("Cannot write lock %s: %w", lockName, err)
+	}
+	return func() {
+		if held, err := readLease(b, lockName); err == nil && held != nil && held.Owner == mine.Owner {
+			if err := b.Delete(lockName); err != nil {
+				log.Printf("Cannot remove lock %s: %v", lockName, err)
+			}
+		}
+	}, nil
+}
+
+func readLease(b Backend, lockName string) (*lease, error) {
+	r, err := b.Get(lockName)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l := new(lease)
+	if err := json.Unmarshal(content, l); err != nil {
+		return nil, fmt.Errorf("invalid lock %s: %v", lockName, err)
+	}
+	return l, nil
+}
+
+// Update is a read-modify-write of filename: modify receives the current content
+// (nil if the object does not exist) and returns the new one, which is written
+// only if nobody else changed the object meanwhile. On conflict the whole cycle is
+// retried, so modify must have no side effects. Nothing is written if modify
+// returns the content unchanged.
+func (s *Data) Update(filename string, modify func(content []byte) ([]byte, error)) error {
+	attempt := func() error {
+		etag := ""
+		var current []byte
+		var previous *generation
+		info, err := s.backend.Stat(filename)
+		if err == nil {
+			etag = info.ETag
+			// archived only once the conditional write proves it is the generation replaced
+			if previous, err = s.currentGeneration(filename); err != nil {
+				return backoff.Permanent(err)
+			}
+			buffer := bufferWriteCloser{new(bytes.Buffer)}
+			if err := s.Download(filename, buffer); err != nil {
+				return backoff.Permanent(err)
+			}
+			current = buffer.Buf.Bytes()
+		} else if err != ErrNotFound {
+			return backoff.Permanent(err)
+		}
+		updated, err := modify(current)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		if (current == nil && updated == nil) || (current != nil && bytes.Equal(current, updated)) {
+			return nil
+		}
+		err = planner.Do(fmt.Sprintf("update %s (%d bytes)", filename, len(updated)), func() error {
+			err := s.writeWith(filename, bytes.NewReader(updated), int64(len(updated)), func(name string, r io.Reader, size int64, metadata map[string]string) error {
+				return putIfMatch(s.backend, name, r, size, metadata, etag)
+			})
+			if err != nil {
+				return err
+			}
+			return s.archiveGeneration(filename, "overwrite", previous)
+		})
+		if err != nil && err != ErrConflict {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	notify := func(err error, wait time.Duration) {
+		log.Printf("%s changed while updating it, retrying in %v", filename, wait)
+	}
+	if err := backoff.RetryNotify(attempt, newConflictBackOff(), notify); err != nil {
+		return fmt.Errorf("Cannot update %s: %w", filename, err)
+	}
+	return nil
+}
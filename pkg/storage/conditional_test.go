@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// plainBackend hides the conditional writes of the wrapped backend
+type plainBackend struct {
+	Backend
+}
+
+func TestUpdateConcurrently(t *testing.T) {
+	defer func(old func() backoff.BackOff) { newConflictBackOff = old }(newConflictBackOff)
+	newConflictBackOff = func() backoff.BackOff {
+		return backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 1000)
+	}
+
+	local, err := newStowBackend(&Config{Provider: "local", LocalPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, backend := range map[string]Backend{
+		"conditional": NewMemoryBackend(),
+		"local":       local,
+	} {
+		store, err := NewData(backend, &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := store.Update("pki/counter", func(content []byte) ([]byte, error) {
+					n, _ := strconv.Atoi(string(content))
+					return []byte(strconv.Itoa(n + 1)), nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		downloaded, err := store.DownloadFilesToMemory([]string{"counter"}, "pki")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(downloaded["counter"]) != "10" {
+			t.Fatalf("%s: lost updates, counter is %s", name, downloaded["counter"])
+		}
+		if store.Exists("pki/counter" + lockSuffix) {
+			t.Fatalf("%s: lock not released", name)
+		}
+	}
+}
+
+func TestUpdateWithoutConditionalWrite(t *testing.T) {
+	backend := plainBackend{NewMemoryBackend()}
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update("pki/vpn/ca.crl", func(content []byte) ([]byte, error) {
+		return []byte("revoked"), nil
+	})
+	if !errors.Is(err, errNoConditionalWrite) {
+		t.Fatalf("expected errNoConditionalWrite, got %v", err)
+	}
+	if names, _ := backend.List(""); len(names) != 0 {
+		t.Fatalf("objects written without a conditional write: %v", names)
+	}
+}
+
+// conflictingBackend fails every conditional write as if somebody else always wrote first
+type conflictingBackend struct {
+	Backend
+}
+
+func (b conflictingBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	return ErrConflict
+}
+
+func TestUpdateConflictError(t *testing.T) {
+	defer func(old func() backoff.BackOff) { newConflictBackOff = old }(newConflictBackOff)
+	newConflictBackOff = func() backoff.BackOff {
+		return backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 3)
+	}
+	store, err := NewData(conflictingBackend{NewMemoryBackend()}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update("pki/vpn/ca.crl", func(content []byte) ([]byte, error) {
+		return []byte("revoked"), nil
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+}
+
+func TestLocalLeaseIsExclusive(t *testing.T) {
+	local, err := newStowBackend(&Config{Provider: "local", LocalPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireLease(local, local, "pki/vpn/ca.crl"+lockSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLease(local, local, "pki/vpn/ca.crl"+lockSuffix); err != ErrConflict {
+		t.Fatalf("a held lease was acquired twice: %v", err)
+	}
+	release()
+	release, err = acquireLease(local, local, "pki/vpn/ca.crl"+lockSuffix)
+	if err != nil {
+		t.Fatalf("a released lease cannot be acquired: %v", err)
+	}
+	release()
+}
+
+// flakyConditionalBackend fails the first conflicts conditional writes
+type flakyConditionalBackend struct {
+	*MemoryBackend
+	conflicts int
+}
+
+func (b *flakyConditionalBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	if b.conflicts > 0 {
+		b.conflicts--
+		return ErrConflict
+	}
+	return b.MemoryBackend.PutIfMatch(name, r, size, metadata, etag)
+}
+
+func TestUpdateArchivesOnce(t *testing.T) {
+	defer func(old func() backoff.BackOff) { newConflictBackOff = old }(newConflictBackOff)
+	newConflictBackOff = func() backoff.BackOff {
+		return backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 10)
+	}
+	backend := &flakyConditionalBackend{MemoryBackend: NewMemoryBackend()}
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadForce("pki/vpn/ca.crl", 5, nopReadCloser("crl-1")); err != nil {
+		t.Fatal(err)
+	}
+	backend.conflicts = 3
+	err = store.Update("pki/vpn/ca.crl", func(content []byte) ([]byte, error) {
+		return []byte("crl-2"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := store.History("pki/vpn/ca.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("expected one archived generation after the retries, got %+v", versions)
+	}
+	if err := store.Rollback("pki/vpn/ca.crl", 1); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := store.DownloadFilesToMemory([]string{"ca.crl"}, "pki/vpn")
+	if err != nil || string(downloaded["ca.crl"]) != "crl-1" {
+		t.Fatalf("the archived generation is not the replaced one: %q (%v)", downloaded["ca.crl"], err)
+	}
+}
@@ -2,15 +2,26 @@ package storage
 
 // Config represent a configuration for working with an object storage
 type Config struct {
-	Provider             string `mapstructure:"provider"`
-	AccessKey            string `mapstructure:"aws_access_key"`
-	SecretKey            string `mapstructure:"aws_secret_key"`
-	AzureStorageAccount  string `mapstructure:"azure_storage_account"`
-	AzureStorageKey      string `mapstructure:"azure_storage_key"`
-	GoogleServiceAccount string `mapstructure:"google_service_account"`
-	GoogleProjectId      string `mapstructure:"google_project_id"`
-	URL                  string `mapstructure:"url"`
-	Region               string `mapstructure:"region"`
-	BucketName           string `mapstructure:"bucketName"`
-	LocalPath            string `mapstructure:"path"`
+	Provider             string            `mapstructure:"provider"`
+	ClusterName          string            `mapstructure:"clusterName"`
+	AccessKey            string            `mapstructure:"aws_access_key"`
+	SecretKey            string            `mapstructure:"aws_secret_key"`
+	AzureStorageAccount  string            `mapstructure:"azure_storage_account"`
+	AzureStorageKey      string            `mapstructure:"azure_storage_key"`
+	GoogleServiceAccount string            `mapstructure:"google_service_account"`
+	GoogleProjectId      string            `mapstructure:"google_project_id"`
+	URL                  string            `mapstructure:"url"`
+	Region               string            `mapstructure:"region"`
+	BucketName           string            `mapstructure:"bucketName"`
+	LocalPath            string            `mapstructure:"path"`
+	Credentials          CredentialsConfig `mapstructure:"credentials"`
+	Vault                VaultConfig       `mapstructure:"vault"`
+	PartSizeMB           int64             `mapstructure:"partSizeMB"`
+	RequireManifest      bool              `mapstructure:"requireManifest"`
+	Replicas             []Config          `mapstructure:"replicas"`
+	WriteQuorum          int               `mapstructure:"writeQuorum"`
+	Compression          CompressionConfig `mapstructure:"compression"`
+	Encryption           EncryptionConfig  `mapstructure:"encryption"`
+	Cache                CacheConfig       `mapstructure:"cache"`
+	Concurrency          int               `mapstructure:"concurrency"`
 }
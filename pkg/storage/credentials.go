@@ -0,0 +1,235 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	defaultAzureMetadataURL   = "http://169.254.169.254"
+	defaultAzureManagementURL = "https://management.azure.com"
+	gceMetadataHostEnv        = "GCE_METADATA_HOST"
+)
+
+// CredentialsConfig tunes how credentials are resolved when the static keys are not set
+type CredentialsConfig struct {
+	// Profile and SharedCredentialsFile select the AWS shared profile, default AWS_PROFILE and ~/.aws/credentials
+	Profile               string `mapstructure:"profile"`
+	SharedCredentialsFile string `mapstructure:"sharedCredentialsFile"`
+	// EC2MetadataURL, GCEMetadataURL and AzureMetadataURL replace the instance metadata endpoints
+	EC2MetadataURL   string `mapstructure:"ec2MetadataURL"`
+	GCEMetadataURL   string `mapstructure:"gceMetadataURL"`
+	AzureMetadataURL string `mapstructure:"azureMetadataURL"`
+	// AzureManagementURL is the Resource Manager endpoint used to read the storage account key
+	AzureManagementURL string `mapstructure:"azureManagementURL"`
+	// AzureClientID selects a user assigned managed identity
+	AzureClientID string `mapstructure:"azureClientId"`
+	// AzureSubscriptionID and AzureResourceGroup locate the storage account, default the ones of the VM
+	AzureSubscriptionID string `mapstructure:"azureSubscriptionId"`
+	AzureResourceGroup  string `mapstructure:"azureResourceGroup"`
+}
+
+// awsCredentials resolves the AWS credentials from the static keys, the environment,
+// the shared profile and the EC2 instance role, in this order
+func awsCredentials(cfg *Config) (*credentials.Credentials, error) {
+	var providers []credentials.Provider
+	if cfg.AccessKey != "" {
+		providers = append(providers, &credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     cfg.AccessKey,
+			SecretAccessKey: cfg.SecretKey,
+		}})
+	}
+	providers = append(providers,
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{
+			Filename: cfg.Credentials.SharedCredentialsFile,
+			Profile:  cfg.Credentials.Profile,
+		},
+	)
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	metadataConfig := aws.NewConfig()
+	if cfg.Credentials.EC2MetadataURL != "" {
+		metadataConfig.WithEndpoint(strings.TrimSuffix(cfg.Credentials.EC2MetadataURL, "/") + "/latest")
+	}
+	providers = append(providers, &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess, metadataConfig)})
+
+	creds := credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true})
+	value, err := creds.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find AWS credentials in the configuration, the environment, the shared profile or the instance metadata: %v", err)
+	}
+	log.Printf("Using AWS credentials from %s", value.ProviderName)
+	return creds, nil
+}
+
+// googleCredentialsJSON returns the configured service account, or an empty string to let
+// the Google SDK look at GOOGLE_APPLICATION_CREDENTIALS, the gcloud credentials and the GCE metadata
+func googleCredentialsJSON(cfg *Config) (string, error) {
+	if cfg.GoogleServiceAccount != "" {
+		sa, err := ioutil.ReadFile(cfg.GoogleServiceAccount)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read Google Service Account file %s: %w", cfg.GoogleServiceAccount, err)
+		}
+		return string(sa), nil
+	}
+	if cfg.Credentials.GCEMetadataURL != "" {
+		// the metadata client of the Google SDK is configured only through the environment
+		u, err := url.Parse(cfg.Credentials.GCEMetadataURL)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid gceMetadataURL %s", cfg.Credentials.GCEMetadataURL)
+		}
+		if err := os.Setenv(gceMetadataHostEnv, u.Host); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// azureStorageKey resolves the key of the storage account from the configuration,
+// AZURE_STORAGE_KEY or the managed identity of the VM, in this order
+func azureStorageKey(cfg *Config, account string) (string, error) {
+	if cfg.AzureStorageKey != "" {
+		return cfg.AzureStorageKey, nil
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		return key, nil
+	}
+	mi := &azureManagedIdentity{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		metadataURL:   strings.TrimSuffix(cfg.Credentials.AzureMetadataURL, "/"),
+		managementURL: strings.TrimSuffix(cfg.Credentials.AzureManagementURL, "/"),
+		cfg:           cfg.Credentials,
+	}
+	if mi.metadataURL == "" {
+		mi.metadataURL = defaultAzureMetadataURL
+	}
+	if mi.managementURL == "" {
+		mi.managementURL = defaultAzureManagementURL
+	}
+	key, err := mi.storageKey(account)
+	if err != nil {
+		return "", fmt.Errorf("Cannot find the Azure storage key in the configuration, AZURE_STORAGE_KEY or the managed identity: %v", err)
+	}
+	log.Println("Using the Azure storage key read with the managed identity")
+	return key, nil
+}
+
+// azureManagedIdentity reads a storage account key through Resource Manager
+// with a token of the managed identity of the VM
+type azureManagedIdentity struct {
+	client        *http.Client
+	metadataURL   string
+	managementURL string
+	cfg           CredentialsConfig
+}
+
+func (mi *azureManagedIdentity) do(req *http.Request, out interface{}) error {
+	res, err := mi.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d: %s", req.Method, req.URL.Path, res.StatusCode, strings.TrimSpace(string(content)))
+	}
+	return json.Unmarshal(content, out)
+}
+
+func (mi *azureManagedIdentity) metadata(path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequest("GET", mi.metadataURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+	return mi.do(req, out)
+}
+
+func (mi *azureManagedIdentity) storageKey(account string) (string, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {mi.managementURL + "/"}}
+	if mi.cfg.AzureClientID != "" {
+		query.Set("client_id", mi.cfg.AzureClientID)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := mi.metadata("/metadata/identity/oauth2/token", query, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("the managed identity returned no token")
+	}
+
+	subscription, group := mi.cfg.AzureSubscriptionID, mi.cfg.AzureResourceGroup
+	if subscription == "" || group == "" {
+		var instance struct {
+			Compute struct {
+				SubscriptionID    string `json:"subscriptionId"`
+				ResourceGroupName string `json:"resourceGroupName"`
+			} `json:"compute"`
+		}
+		if err := mi.metadata("/metadata/instance", url.Values{"api-version": {"2019-06-01"}}, &instance); err != nil {
+			return "", err
+		}
+		if subscription == "" {
+			subscription = instance.Compute.SubscriptionID
+		}
+		if group == "" {
+			group = instance.Compute.ResourceGroupName
+		}
+	}
+
+	listKeys := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s/listKeys?api-version=2019-06-01",
+		mi.managementURL, subscription, group, account)
+	req, err := http.NewRequest("POST", listKeys, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	var keys struct {
+		Keys []struct {
+			Value string `json:"value"`
+		} `json:"keys"`
+	}
+	if err := mi.do(req, &keys); err != nil {
+		return "", err
+	}
+	if len(keys.Keys) == 0 {
+		return "", fmt.Errorf("storage account %s has no keys", account)
+	}
+	return keys.Keys[0].Value, nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2/google"
+)
+
+// setenv sets the environment variables for the duration of a test
+func setenv(t *testing.T, env map[string]string) func() {
+	old := map[string]*string{}
+	for k, v := range env {
+		if value, ok := os.LookupEnv(k); ok {
+			old[k] = &value
+		} else {
+			old[k] = nil
+		}
+		if v == "" {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, v)
+		}
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestAWSCredentialsChain(t *testing.T) {
+	home, err := ioutil.TempDir("", "furyagent-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer setenv(t, map[string]string{
+		"HOME": home, "AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_ACCESS_KEY": "",
+		"AWS_SECRET_KEY": "", "AWS_PROFILE": "", "AWS_SHARED_CREDENTIALS_FILE": "",
+	})()
+
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			w.Write([]byte("node-role"))
+		case "/latest/meta-data/iam/security-credentials/node-role":
+			json.NewEncoder(w).Encode(map[string]string{
+				"Code": "Success", "AccessKeyId": "instance", "SecretAccessKey": "secret",
+				"Token": "token", "Expiration": "2100-01-01T00:00:00Z",
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ec2.Close()
+
+	cfg := &Config{Credentials: CredentialsConfig{EC2MetadataURL: ec2.URL}}
+	check := func(expected string) {
+		t.Helper()
+		creds, err := awsCredentials(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := creds.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value.AccessKeyID != expected {
+			t.Fatalf("expected credentials %s, got %s from %s", expected, value.AccessKeyID, value.ProviderName)
+		}
+	}
+	check("instance")
+
+	profiles := filepath.Join(home, "credentials")
+	ioutil.WriteFile(profiles, []byte("[fury]\naws_access_key_id = profile\naws_secret_access_key = secret\n"), 0600)
+	cfg.Credentials.SharedCredentialsFile = profiles
+	cfg.Credentials.Profile = "fury"
+	check("profile")
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "env")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	check("env")
+
+	cfg.AccessKey, cfg.SecretKey = "static", "secret"
+	check("static")
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	defer setenv(t, map[string]string{"AZURE_STORAGE_KEY": ""})()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != server.URL+"/" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "mi-token"})
+		case "/metadata/instance":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"compute": map[string]string{"subscriptionId": "sub", "resourceGroupName": "rg"},
+			})
+		case "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/fury/listKeys":
+			if r.Method != "POST" || r.Header.Get("Authorization") != "Bearer mi-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{"value": "account-key"}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &Config{Credentials: CredentialsConfig{AzureMetadataURL: server.URL, AzureManagementURL: server.URL}}
+	key, err := azureStorageKey(cfg, "fury")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "account-key" {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if _, err := azureStorageKey(cfg, "other"); err == nil {
+		t.Fatal("expected an error for an unknown storage account")
+	}
+	cfg.AzureStorageKey = "static"
+	if key, _ := azureStorageKey(cfg, "fury"); key != "static" {
+		t.Fatalf("the static key must win, got %s", key)
+	}
+}
+
+func TestGCEMetadataCredentials(t *testing.T) {
+	home, err := ioutil.TempDir("", "furyagent-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	defer setenv(t, map[string]string{
+		"HOME": home, "GOOGLE_APPLICATION_CREDENTIALS": "", "CLOUDSDK_CONFIG": "", gceMetadataHostEnv: "",
+	})()
+
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" || r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "gce-token", "expires_in": 3600, "token_type": "Bearer"})
+	}))
+	defer gce.Close()
+
+	sa, err := googleCredentialsJSON(&Config{Credentials: CredentialsConfig{GCEMetadataURL: gce.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa != "" {
+		t.Fatal("no service account is configured")
+	}
+	creds, err := google.FindDefaultCredentials(context.Background(), "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "gce-token" {
+		t.Fatalf("unexpected token %s", token.AccessToken)
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+func TestDryRun(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadFilesFromMemory(map[string][]byte{"ca.crt": []byte("crt")}, "pki/master"); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	defer func(p *planner.Planner) { planner.Default = p }(planner.Default)
+	planner.Default = &planner.Planner{DryRun: true, Out: out}
+
+	if err := store.UploadFilesFromMemory(map[string][]byte{"ca.key": []byte("key")}, "pki/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove("pki/master/ca.crt"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := backend.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "pki/master/"+ManifestFile || names[1] != "pki/master/ca.crt" {
+		t.Fatalf("the bucket changed in dry-run mode: %v", names)
+	}
+	for _, action := range []string{"would upload pki/master/ca.key (3 bytes)", "would remove pki/master/ca.crt"} {
+		if !strings.Contains(out.String(), action) {
+			t.Fatalf("%q not planned in:\n%s", action, out.String())
+		}
+	}
+}
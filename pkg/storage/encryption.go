@@ -0,0 +1,443 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// encryptionMagic prefixes every object written through an encrypting Data
+	encryptionMagic     = "furyagent/enc/v1\n"
+	encryptionCipher    = "AES-256-GCM"
+	encryptionChunkSize = 64 * 1024
+	dataKeySize         = 32
+	// maxEncryptionHeaderSize bounds the header read from an object, which only holds the wrapped data keys
+	maxEncryptionHeaderSize = 1024 * 1024
+
+	keyTypePassphrase = "passphrase"
+	keyTypeKeyFile    = "keyfile"
+	keyTypeAge        = "age"
+)
+
+// ErrEncryptedObject is returned when an encrypted object is read without any usable key
+var ErrEncryptedObject = errors.New("object is encrypted and no matching key is configured")
+
+// EncryptionConfig represent the keys used to wrap the per-object data keys.
+// Every configured key can decrypt an object, so a node can e.g. write with
+// age recipients only and never hold the identity able to read the CA back.
+type EncryptionConfig struct {
+	Passphrase      string   `mapstructure:"passphrase"`
+	KeyFile         string   `mapstructure:"keyFile"`
+	AgeRecipients   []string `mapstructure:"ageRecipients"`
+	AgeIdentityFile string   `mapstructure:"ageIdentityFile"`
+}
+
+type envelopeHeader struct {
+	Cipher    string           `json:"cipher"`
+	ChunkSize int              `json:"chunkSize"`
+	Nonce     []byte           `json:"nonce"`
+	Keys      []wrappedDataKey `json:"keys"`
+}
+
+type wrappedDataKey struct {
+	Type  string `json:"type"`
+	Salt  []byte `json:"salt,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	Key   []byte `json:"key"`
+}
+
+// envelope seals objects with a random AES-256-GCM data key, wrapped by every configured key
+type envelope struct {
+	passphrase []byte
+	key        []byte
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// newEnvelope returns nil when no encryption key is configured
+func newEnvelope(cfg EncryptionConfig) (*envelope, error) {
+	e := new(envelope)
+	if cfg.Passphrase != "" {
+		e.passphrase = []byte(cfg.Passphrase)
+	}
+	if cfg.KeyFile != "" {
+		key, err := readKeyFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		e.key = key
+	}
+	for _, r := range cfg.AgeRecipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %v", r, err)
+		}
+		e.recipients = append(e.recipients, recipient)
+	}
+	if cfg.AgeIdentityFile != "" {
+		f, err := os.Open(cfg.AgeIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read age identity file %s: %w", cfg.AgeIdentityFile, err)
+		}
+		defer f.Close()
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age identity file %s: %v", cfg.AgeIdentityFile, err)
+		}
+		e.identities = identities
+	}
+	if e.passphrase == nil && e.key == nil && len(e.recipients) == 0 {
+		if len(e.identities) > 0 {
+			return nil, errors.New("ageIdentityFile requires at least one of ageRecipients, passphrase or keyFile")
+		}
+		return nil, nil
+	}
+	return e, nil
+}
+
+// readKeyFile accepts either 32 raw bytes or their base64 encoding
+func readKeyFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read encryption key file %s: %w", path, err)
+	}
+	if len(content) == dataKeySize {
+		return content, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != dataKeySize {
+		return nil, fmt.Errorf("encryption key file %s must contain %d raw or base64 encoded bytes", path, dataKeySize)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+func passphraseKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, dataKeySize)
+}
+
+func wrapWithKey(kek, dataKey []byte) (nonce, wrapped []byte, err error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err = randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, dataKey, nil), nil
+}
+
+func unwrapWithKey(kek []byte, w wrappedDataKey) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, w.Nonce, w.Key, nil)
+}
+
+func (e *envelope) wrap(dataKey []byte) ([]wrappedDataKey, error) {
+	var keys []wrappedDataKey
+	if e.passphrase != nil {
+		salt, err := randomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := passphraseKey(e.passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		nonce, wrapped, err := wrapWithKey(kek, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, wrappedDataKey{Type: keyTypePassphrase, Salt: salt, Nonce: nonce, Key: wrapped})
+	}
+	if e.key != nil {
+		nonce, wrapped, err := wrapWithKey(e.key, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, wrappedDataKey{Type: keyTypeKeyFile, Nonce: nonce, Key: wrapped})
+	}
+	if len(e.recipients) > 0 {
+		buf := new(bytes.Buffer)
+		w, err := age.Encrypt(buf, e.recipients...)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(dataKey); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		keys = append(keys, wrappedDataKey{Type: keyTypeAge, Key: buf.Bytes()})
+	}
+	return keys, nil
+}
+
+func (e *envelope) unwrap(keys []wrappedDataKey) ([]byte, error) {
+	for _, k := range keys {
+		var dataKey []byte
+		var err error
+		switch k.Type {
+		case keyTypePassphrase:
+			if e.passphrase == nil {
+				continue
+			}
+			var kek []byte
+			if kek, err = passphraseKey(e.passphrase, k.Salt); err == nil {
+				dataKey, err = unwrapWithKey(kek, k)
+			}
+		case keyTypeKeyFile:
+			if e.key == nil {
+				continue
+			}
+			dataKey, err = unwrapWithKey(e.key, k)
+		case keyTypeAge:
+			if len(e.identities) == 0 {
+				continue
+			}
+			var r io.Reader
+			if r, err = age.Decrypt(bytes.NewReader(k.Key), e.identities...); err == nil {
+				dataKey, err = ioutil.ReadAll(r)
+			}
+		default:
+			continue
+		}
+		if err == nil && len(dataKey) == dataKeySize {
+			return dataKey, nil
+		}
+	}
+	return nil, ErrEncryptedObject
+}
+
+// seal returns a reader producing the encrypted form of r and its exact size
+func (e *envelope) seal(r io.Reader, size int64) (io.Reader, int64, error) {
+	dataKey, err := randomBytes(dataKeySize)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	nonce, err := randomBytes(aead.NonceSize())
+	if err != nil {
+		return nil, 0, err
+	}
+	keys, err := e.wrap(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	header, err := json.Marshal(envelopeHeader{
+		Cipher:    encryptionCipher,
+		ChunkSize: encryptionChunkSize,
+		Nonce:     nonce,
+		Keys:      keys,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix := new(bytes.Buffer)
+	prefix.WriteString(encryptionMagic)
+	binary.Write(prefix, binary.BigEndian, uint32(len(header)))
+	prefix.Write(header)
+
+	// the last chunk is always shorter than chunkSize, possibly empty
+	chunks := size/encryptionChunkSize + 1
+	sealedSize := int64(prefix.Len()) + size + chunks*int64(aead.Overhead())
+	sr := &sealReader{
+		src:   r,
+		aead:  aead,
+		nonce: nonce,
+		chunk: make([]byte, encryptionChunkSize),
+	}
+	return io.MultiReader(prefix, sr), sealedSize, nil
+}
+
+// open returns a reader with the plaintext of r. Objects that were not
+// written encrypted are returned as they are, so plaintext uploads made
+// before encryption was configured are still readable.
+func (e *envelope) open(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encryptionMagic))
+	if err != nil || string(magic) != encryptionMagic {
+		return br, nil
+	}
+	if e == nil {
+		return nil, ErrEncryptedObject
+	}
+	br.Discard(len(encryptionMagic))
+	var headerLen uint32
+	if err := binary.Read(br, binary.BigEndian, &headerLen); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	if headerLen > maxEncryptionHeaderSize {
+		return nil, fmt.Errorf("invalid encryption header: %d bytes", headerLen)
+	}
+	rawHeader := make([]byte, headerLen)
+	if _, err := io.ReadFull(br, rawHeader); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	var header envelopeHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %v", err)
+	}
+	if header.Cipher != encryptionCipher {
+		return nil, fmt.Errorf("unsupported encryption cipher %s", header.Cipher)
+	}
+	// the chunk buffer is allocated from the header, never trust its size
+	if header.ChunkSize != encryptionChunkSize {
+		return nil, fmt.Errorf("invalid encryption header: unsupported chunk size %d", header.ChunkSize)
+	}
+	dataKey, err := e.unwrap(header.Keys)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid encryption header: bad nonce")
+	}
+	return &openReader{
+		src:   br,
+		aead:  aead,
+		nonce: header.Nonce,
+		chunk: make([]byte, header.ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// chunkNonce derives a unique nonce per chunk from the object base nonce
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, len(base))
+	copy(nonce, base)
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	for i := range c {
+		nonce[len(nonce)-8+i] ^= c[i]
+	}
+	return nonce
+}
+
+// chunkAD binds the position of the final chunk so that truncation is detected
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type sealReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	done    bool
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.src, s.chunk)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return 0, err
+		}
+		s.out = s.aead.Seal(s.out[:0], chunkNonce(s.nonce, s.counter), s.chunk[:n], chunkAD(final))
+		s.counter++
+		s.done = final
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+type openReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	nonce   []byte
+	counter uint64
+	chunk   []byte
+	out     []byte
+	done    bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		// a full chunk is never the final one, the final one is always shorter
+		n, err := io.ReadFull(o.src, o.chunk)
+		final := false
+		if err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err == io.EOF {
+			return 0, errors.New("encrypted object is truncated")
+		} else if err != nil {
+			return 0, err
+		}
+		out, err := o.aead.Open(o.out[:0], chunkNonce(o.nonce, o.counter), o.chunk[:n], chunkAD(final))
+		if err != nil {
+			return 0, fmt.Errorf("cannot decrypt object: %v", err)
+		}
+		o.out = out
+		o.counter++
+		o.done = final
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	identityFile := filepath.Join(dir, "identity.txt")
+	if err := ioutil.WriteFile(identityFile, []byte(identity.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := newEnvelope(EncryptionConfig{
+		Passphrase:    "secret",
+		AgeRecipients: []string{identity.Recipient().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers := map[string]EncryptionConfig{
+		"passphrase": {Passphrase: "secret"},
+		"age":        {AgeRecipients: []string{identity.Recipient().String()}, AgeIdentityFile: identityFile},
+	}
+	for _, size := range []int{0, 10, encryptionChunkSize, 3*encryptionChunkSize + 7} {
+		plain := bytes.Repeat([]byte{'k'}, size)
+		sealed, sealedSize, err := writer.seal(bytes.NewReader(plain), int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadAll(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(ciphertext)) != sealedSize {
+			t.Fatalf("size %d: announced %d bytes, produced %d", size, sealedSize, len(ciphertext))
+		}
+		for name, cfg := range readers {
+			reader, err := newEnvelope(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := reader.open(bytes.NewReader(ciphertext))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("%s: size %d: plaintext mismatch", name, size)
+			}
+		}
+		if _, err := ioutil.ReadAll(mustOpen(t, writer, ciphertext[:len(ciphertext)-1])); err == nil {
+			t.Fatalf("size %d: truncated object decrypted without error", size)
+		}
+	}
+}
+
+func TestEnvelopePlaintextPassthrough(t *testing.T) {
+	var e *envelope
+	plain := []byte("-----BEGIN CERTIFICATE-----")
+	r, err := e.open(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(got, plain) {
+		t.Fatal("plaintext object was modified")
+	}
+
+	writer, _ := newEnvelope(EncryptionConfig{Passphrase: "secret"})
+	sealed, _, _ := writer.seal(bytes.NewReader(plain), int64(len(plain)))
+	ciphertext, _ := ioutil.ReadAll(sealed)
+	if _, err := e.open(bytes.NewReader(ciphertext)); err != ErrEncryptedObject {
+		t.Fatalf("expected ErrEncryptedObject, got %v", err)
+	}
+}
+
+func TestEnvelopeRejectsForgedHeader(t *testing.T) {
+	e, err := newEnvelope(EncryptionConfig{Passphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forge := func(headerLen uint32, header string) []byte {
+		object := bytes.NewBufferString(encryptionMagic)
+		binary.Write(object, binary.BigEndian, headerLen)
+		object.WriteString(header)
+		return object.Bytes()
+	}
+	withHeader := func(header string) []byte {
+		return forge(uint32(len(header)), header)
+	}
+	for name, object := range map[string][]byte{
+		"huge chunk":   withHeader(`{"cipher":"AES-256-GCM","chunkSize":9223372036854775807}`),
+		"other chunk":  withHeader(`{"cipher":"AES-256-GCM","chunkSize":1024}`),
+		"other cipher": withHeader(`{"cipher":"none","chunkSize":65536}`),
+		"huge header":  forge(1<<31, ""),
+	} {
+		if _, err := e.open(bytes.NewReader(object)); err == nil {
+			t.Fatalf("%s: forged header accepted", name)
+		}
+	}
+}
+
+func mustOpen(t *testing.T, e *envelope, ciphertext []byte) *openReader {
+	r, err := e.open(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*openReader)
+}
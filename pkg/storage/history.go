@@ -0,0 +1,188 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// HistoryPrefix is where the previous generations of versioned objects are kept
+	HistoryPrefix = "history"
+
+	historyTimeFormat = "20060102T150405.000000000Z"
+	historyInfoSuffix = ".json"
+)
+
+// versionedPrefixes lists the paths whose objects are archived before being replaced or removed
+var versionedPrefixes = []string{"pki/"}
+
+// Version describes a previous generation of an object
+type Version struct {
+	Number    int       `json:"-"`
+	Path      string    `json:"path"`
+	Timestamp time.Time `json:"timestamp"`
+	Uploader  string    `json:"uploader"`
+	Hostname  string    `json:"hostname"`
+	Operation string    `json:"operation"`
+	Size      int64     `json:"size"`
+}
+
+func isVersioned(filename string) bool {
+	if isManifest(filename) {
+		return false
+	}
+	for _, prefix := range versionedPrefixes {
+		if strings.HasPrefix(filename, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func historyDir(filename string) string {
+	return path.Join(HistoryPrefix, filename) + "/"
+}
+
+// generation is the stored content of an object, as read before replacing it
+type generation struct {
+	info    *ObjectInfo
+	content []byte
+}
+
+// archive copies the current generation of filename in the history, if any.
+// The stored bytes are copied as they are, so encrypted objects stay encrypted.
+func (s *Data) archive(filename, operation string) error {
+	previous, err := s.currentGeneration(filename)
+	if err != nil {
+		return err
+	}
+	return s.archiveGeneration(filename, operation, previous)
+}
+
+// currentGeneration reads the stored bytes of filename if it is versioned, nil otherwise or if it does not exist
+func (s *Data) currentGeneration(filename string) (*generation, error) {
+	if !isVersioned(filename) {
+		return nil, nil
+	}
+	info, err := s.backend.Stat(filename)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	reader, err := s.backend.Get(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &generation{info: info, content: content}, nil
+}
+
+// archiveGeneration stores previous, a generation of filename read by currentGeneration, in the history
+func (s *Data) archiveGeneration(filename, operation string, previous *generation) error {
+	if previous == nil {
+		return nil
+	}
+	info := previous.info
+	now := time.Now().UTC()
+	version := Version{
+		Path:      filename,
+		Timestamp: now,
+		Operation: operation,
+		Size:      int64(len(previous.content)),
+	}
+	if u, err := user.Current(); err == nil {
+		version.Uploader = u.Username
+	}
+	version.Hostname, _ = os.Hostname()
+	versionPath := historyDir(filename) + now.Format(historyTimeFormat)
+	log.Printf("archiving %s to %s", filename, versionPath)
+	if err := s.backend.Put(versionPath, bytes.NewReader(previous.content), int64(len(previous.content)), info.Metadata); err != nil {
+		return fmt.Errorf("Cannot archive %s: %w", filename, err)
+	}
+	versionInfo, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return s.backend.Put(versionPath+historyInfoSuffix, bytes.NewReader(versionInfo), int64(len(versionInfo)), nil)
+}
+
+// History lists the archived generations of filename, oldest first (version 1)
+func (s *Data) History(filename string) ([]Version, error) {
+	names, err := s.backend.List(historyDir(filename))
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	for _, name := range names {
+		if !strings.HasSuffix(name, historyInfoSuffix) {
+			continue
+		}
+		reader, err := s.backend.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		var version Version
+		if err := json.Unmarshal(content, &version); err != nil {
+			return nil, fmt.Errorf("invalid history entry %s: %v", name, err)
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Timestamp.Before(versions[j].Timestamp)
+	})
+	for i := range versions {
+		versions[i].Number = i + 1
+	}
+	return versions, nil
+}
+
+// Rollback restores the given version of filename, archiving the current one first
+func (s *Data) Rollback(filename string, number int) error {
+	versions, err := s.History(filename)
+	if err != nil {
+		return err
+	}
+	if number < 1 || number > len(versions) {
+		return fmt.Errorf("version %d of %s %w, %d versions available", number, filename, ErrNotFound, len(versions))
+	}
+	versionPath := historyDir(filename) + versions[number-1].Timestamp.Format(historyTimeFormat)
+	buf := bufferWriteCloser{new(bytes.Buffer)}
+	if err := s.Download(versionPath, buf); err != nil {
+		return fmt.Errorf("Cannot read version %d of %s: %w", number, filename, err)
+	}
+	log.Printf("restoring version %d of %s", number, filename)
+	return s.write(filename, buf.Buf, int64(buf.Buf.Len()), "rollback")
+}
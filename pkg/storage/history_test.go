@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestHistoryRollback(t *testing.T) {
+	store, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, crl := range []string{"crl-1", "crl-2", "crl-3"} {
+		if err := store.UploadForce("pki/vpn/ca.crl", int64(len(crl)), nopReadCloser(crl)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.UploadForce("join/join.sh", 2, nopReadCloser("sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadForce("join/join.sh", 2, nopReadCloser("sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := store.History("pki/vpn/ca.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Size != 5 || versions[0].Operation != "overwrite" {
+		t.Fatalf("unexpected history: %+v", versions)
+	}
+	if versions, _ := store.History("join/join.sh"); len(versions) != 0 {
+		t.Fatalf("objects outside pki/ must not be versioned: %+v", versions)
+	}
+
+	if err := store.Rollback("pki/vpn/ca.crl", 1); err != nil {
+		t.Fatal(err)
+	}
+	files, err := store.DownloadFilesToMemory([]string{"ca.crl"}, "pki/vpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(files["ca.crl"]) != "crl-1" {
+		t.Fatalf("rollback restored %q", files["ca.crl"])
+	}
+	if versions, _ := store.History("pki/vpn/ca.crl"); len(versions) != 3 || versions[2].Operation != "rollback" {
+		t.Fatalf("the replaced version was not archived: %+v", versions)
+	}
+	if err := store.Rollback("pki/vpn/ca.crl", 10); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound rolling back to a missing version, got %v", err)
+	}
+}
+
+func nopReadCloser(s string) io.ReadCloser {
+	return ioutil.NopCloser(strings.NewReader(s))
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"path"
+	"time"
+)
+
+// ManifestFile is the name of the manifest kept in every directory of the bucket
+const ManifestFile = "MANIFEST.json"
+
+// Manifest records the SHA-256 of the plaintext of every object in a directory.
+// When encryption is enabled the manifest itself is encrypted and authenticated.
+type Manifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is the expected content of a single object
+type ManifestEntry struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+// digester computes the manifest entry of the bytes written to it
+type digester struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigester() *digester {
+	return &digester{hash: sha256.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	return d.hash.Write(p)
+}
+
+func (d *digester) sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+func (d *digester) entry() *ManifestEntry {
+	return &ManifestEntry{SHA256: d.sum(), Size: d.size, Updated: time.Now().UTC()}
+}
+
+func isManifest(filename string) bool {
+	return path.Base(filename) == ManifestFile
+}
+
+// Manifest returns the manifest of the given directory, nil if it has none
+func (s *Data) Manifest(dir string) (*Manifest, error) {
+	name := path.Join(dir, ManifestFile)
+	if !s.Exists(name) {
+		return nil, nil
+	}
+	buf := bufferWriteCloser{new(bytes.Buffer)}
+	if err := s.Download(name, buf); err != nil {
+		return nil, err
+	}
+	manifest := new(Manifest)
+	if err := json.Unmarshal(buf.Buf.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", name, err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]ManifestEntry{}
+	}
+	return manifest, nil
+}
+
+// updateManifest sets (or removes, when entry is nil) the entry of filename in its directory manifest
+func (s *Data) updateManifest(filename string, entry *ManifestEntry) error {
+	dir, base := path.Split(filename)
+	name := path.Join(dir, ManifestFile)
+	defer s.manifestLocks.lock(name)()
+	return s.Update(name, func(content []byte) ([]byte, error) {
+		manifest := &Manifest{Files: map[string]ManifestEntry{}}
+		if content == nil {
+			if entry == nil {
+				return nil, nil
+			}
+		} else if err := json.Unmarshal(content, manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %v", name, err)
+		}
+		if manifest.Files == nil {
+			manifest.Files = map[string]ManifestEntry{}
+		}
+		if entry == nil {
+			delete(manifest.Files, base)
+		} else {
+			manifest.Files[base] = *entry
+		}
+		return json.MarshalIndent(manifest, "", "  ")
+	})
+}
+
+// verify checks the digest of a downloaded object against the manifest of its directory
+func (s *Data) verify(manifest *Manifest, bucketPath, sum string, size int64) error {
+	if manifest == nil {
+		if s.requireManifest {
+			return fmt.Errorf("%s has no %s, refusing to install it", bucketPath, ManifestFile)
+		}
+		log.Printf("no %s for %s, skipping integrity check", ManifestFile, bucketPath)
+		return nil
+	}
+	entry, ok := manifest.Files[path.Base(bucketPath)]
+	if !ok {
+		if s.requireManifest {
+			return fmt.Errorf("%s is not listed in %s, refusing to install it", bucketPath, ManifestFile)
+		}
+		log.Printf("%s is not listed in %s, skipping integrity check", bucketPath, ManifestFile)
+		return nil
+	}
+	if entry.SHA256 != sum || entry.Size != size {
+		return fmt.Errorf("integrity check failed for %s: expected sha256 %s (%d bytes), got %s (%d bytes)", bucketPath, entry.SHA256, entry.Size, sum, size)
+	}
+	return nil
+}
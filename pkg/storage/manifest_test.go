@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifestVerification(t *testing.T) {
+	backend := NewMemoryBackend()
+	store, err := NewData(backend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{"ca.crt": []byte("certificate"), "ca.key": []byte("key")}
+	if err := store.UploadFilesFromMemory(files, "pki/master"); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := store.Manifest("pki/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 2 || manifest.Files["ca.key"].Size != 3 {
+		t.Fatalf("unexpected manifest: %+v", manifest)
+	}
+	if listed, _ := store.List("pki/master"); len(listed) != 2 {
+		t.Fatalf("the manifest must not be listed: %v", listed)
+	}
+
+	mappings := [][]string{{"ca.pem", "ca.crt"}, {"ca-key.pem", "ca.key"}}
+	if err := store.DownloadFilesToDirectory(mappings, dir, "pki/master", false); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := "tampered!!!"
+	if err := backend.Put("pki/master/ca.crt", strings.NewReader(tampered), int64(len(tampered)), nil); err != nil {
+		t.Fatal(err)
+	}
+	err = store.DownloadFilesToDirectory(mappings, dir, "pki/master", true)
+	if err == nil || !strings.Contains(err.Error(), "integrity check failed") {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	installed, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil || string(installed) != "certificate" {
+		t.Fatalf("the installed file was replaced: %q %v", installed, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".*")); len(leftovers) != 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+
+	if err := store.Remove("pki/master/ca.key"); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, _ := store.Manifest("pki/master"); len(manifest.Files) != 1 {
+		t.Fatalf("removed file still in manifest: %+v", manifest)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data     []byte
+	modTime  time.Time
+	metadata map[string]string
+}
+
+type memoryUpload struct {
+	name     string
+	metadata map[string]string
+	parts    map[int][]byte
+}
+
+// MemoryBackend keeps every object in memory, it is meant for tests
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+	uploads map[string]*memoryUpload
+	nextID  int
+}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: map[string]memoryObject{},
+		uploads: map[string]*memoryUpload{},
+	}
+}
+
+// Get implements Backend
+func (m *MemoryBackend) Get(name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+// Put implements Backend
+func (m *MemoryBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	return m.put(name, r, size, metadata, nil)
+}
+
+// PutIfMatch implements ConditionalBackend
+func (m *MemoryBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	return m.put(name, r, size, metadata, &etag)
+}
+
+func (m *MemoryBackend) put(name string, r io.Reader, size int64, metadata map[string]string, ifMatch *string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("bad size for %s: expected %d bytes, got %d", name, size, len(data))
+	}
+	md := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		md[k] = v
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ifMatch != nil {
+		current := ""
+		if obj, ok := m.objects[name]; ok {
+			current = fmt.Sprintf("%x", md5.Sum(obj.data))
+		}
+		if current != *ifMatch {
+			return ErrConflict
+		}
+	}
+	m.objects[name] = memoryObject{data: data, modTime: time.Now(), metadata: md}
+	return nil
+}
+
+// List implements Backend
+func (m *MemoryBackend) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var names []string
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements Backend
+func (m *MemoryBackend) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.objects, name)
+	return nil
+}
+
+// Stat implements Backend
+func (m *MemoryBackend) Stat(name string) (*ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	md := make(map[string]string, len(obj.metadata))
+	for k, v := range obj.metadata {
+		md[k] = v
+	}
+	return &ObjectInfo{
+		Name:         name,
+		Size:         int64(len(obj.data)),
+		ETag:         fmt.Sprintf("%x", md5.Sum(obj.data)),
+		LastModified: obj.modTime,
+		Metadata:     md,
+	}, nil
+}
+
+// Close implements Backend
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// CreateMultipartUpload implements MultipartBackend
+func (m *MemoryBackend) CreateMultipartUpload(name string, metadata map[string]string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	id := fmt.Sprintf("upload-%d", m.nextID)
+	m.uploads[id] = &memoryUpload{name: name, metadata: metadata, parts: map[int][]byte{}}
+	return id, nil
+}
+
+func (m *MemoryBackend) upload(name, uploadID string) (*memoryUpload, error) {
+	upload, ok := m.uploads[uploadID]
+	if !ok || upload.name != name {
+		return nil, fmt.Errorf("no upload %s for %s", uploadID, name)
+	}
+	return upload, nil
+}
+
+// UploadPart implements MultipartBackend
+func (m *MemoryBackend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, err := m.upload(name, uploadID)
+	if err != nil {
+		return "", err
+	}
+	upload.parts[number] = append([]byte(nil), data...)
+	return etag(data), nil
+}
+
+// ListParts implements MultipartBackend
+func (m *MemoryBackend) ListParts(name, uploadID string) ([]Part, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	upload, err := m.upload(name, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Part
+	for number, data := range upload.parts {
+		parts = append(parts, Part{Number: number, ETag: etag(data), Size: int64(len(data))})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// CompleteMultipartUpload implements MultipartBackend
+func (m *MemoryBackend) CompleteMultipartUpload(name, uploadID string, parts []Part) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, err := m.upload(name, uploadID)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, p := range parts {
+		part, ok := upload.parts[p.Number]
+		if !ok || etag(part) != p.ETag {
+			return fmt.Errorf("invalid part %d for upload %s", p.Number, uploadID)
+		}
+		data = append(data, part...)
+	}
+	m.objects[name] = memoryObject{data: data, modTime: time.Now(), metadata: upload.metadata}
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+// AbortMultipartUpload implements MultipartBackend
+func (m *MemoryBackend) AbortMultipartUpload(name, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.upload(name, uploadID); err != nil {
+		return err
+	}
+	delete(m.uploads, uploadID)
+	return nil
+}
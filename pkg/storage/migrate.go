@@ -0,0 +1,219 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+// MigrateOptions tunes Migrate
+type MigrateOptions struct {
+	// DryRun only reports what would be copied
+	DryRun bool
+	// StatePath records the migrated objects, a new run with the same file skips them
+	StatePath string
+	// Overwrite replaces the objects of the destination with a different content
+	Overwrite bool
+}
+
+// MigrateReport summarizes a migration
+type MigrateReport struct {
+	Copied    []string
+	Skipped   []string
+	Failed    map[string]error
+	Bytes     int64
+	DryRun    bool
+	Resumed   int
+	Identical int
+}
+
+// migrateState is the content of MigrateOptions.StatePath, object name to sha256
+type migrateState struct {
+	Done map[string]string `json:"done"`
+}
+
+func loadMigrateState(statePath string) (*migrateState, error) {
+	state := &migrateState{Done: map[string]string{}}
+	if statePath == "" {
+		return state, nil
+	}
+	content, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("invalid migration state %s: %v", statePath, err)
+	}
+	if state.Done == nil {
+		state.Done = map[string]string{}
+	}
+	return state, nil
+}
+
+func (m *migrateState) save(statePath string) error {
+	if statePath == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, content, 0600)
+}
+
+// isInternal reports whether name is kept by furyagent for itself and not migrated: the manifests,
+// rebuilt by the destination, the locks, the history of the versioned objects and the probes of Check
+func isInternal(name string) bool {
+	return isManifest(name) || isLock(name) || strings.HasPrefix(name, HistoryPrefix+"/") || strings.HasPrefix(name, checkPrefix)
+}
+
+// sha256Of downloads filename and returns the checksum of its content, writing it to w if not nil
+func (s *Data) sha256Of(filename string, w io.Writer) (string, int64, error) {
+	digest := newDigester()
+	out := io.Writer(digest)
+	if w != nil {
+		out = io.MultiWriter(w, digest)
+	}
+	if err := s.Download(filename, teeWriteCloser{Writer: out, Closer: ioutil.NopCloser(nil)}); err != nil {
+		return "", 0, err
+	}
+	return digest.sum(), digest.size, nil
+}
+
+// Migrate copies every object of src to dst, verifying the checksum of each copy.
+// Manifests are not copied, dst rebuilds its own while the objects are written.
+// An object already in dst with the same content is skipped, so an interrupted
+// migration can be run again; with a StatePath the migrated objects are not even read.
+func Migrate(src, dst *Data, opts MigrateOptions) (*MigrateReport, error) {
+	opts.DryRun = opts.DryRun || planner.DryRun()
+	report := &MigrateReport{Failed: map[string]error{}, DryRun: opts.DryRun}
+	state, err := loadMigrateState(opts.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	names, err := src.backend.List("")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list the source bucket: %w", err)
+	}
+	for _, name := range names {
+		if isInternal(name) {
+			continue
+		}
+		if _, ok := state.Done[name]; ok {
+			report.Skipped = append(report.Skipped, name)
+			report.Resumed++
+			continue
+		}
+		if opts.DryRun {
+			info, err := src.backend.Stat(name)
+			if err != nil {
+				report.Failed[name] = err
+				continue
+			}
+			log.Printf("would copy %s (%d bytes)", name, info.Size)
+			report.Copied = append(report.Copied, name)
+			report.Bytes += info.Size
+			continue
+		}
+		sum, size, identical, err := migrateObject(src, dst, name, opts.Overwrite)
+		if err != nil {
+			log.Printf("Cannot migrate %s: %v", name, err)
+			report.Failed[name] = err
+			continue
+		}
+		state.Done[name] = sum
+		if err := state.save(opts.StatePath); err != nil {
+			return report, fmt.Errorf("Cannot save the migration state: %w", err)
+		}
+		if identical {
+			report.Skipped = append(report.Skipped, name)
+			report.Identical++
+			continue
+		}
+		report.Copied = append(report.Copied, name)
+		report.Bytes += size
+	}
+	return report, nil
+}
+
+// migrateObject copies name from src to dst through a temporary file and checks
+// that dst returns the same content. The object keeps the metadata of src, like its
+// provenance, except the compression which depends on the configuration of dst.
+func migrateObject(src, dst *Data, name string, overwrite bool) (string, int64, bool, error) {
+	info, err := src.backend.Stat(name)
+	if err != nil {
+		return "", 0, false, err
+	}
+	tmp, err := ioutil.TempFile("", "furyagent-migrate")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum, size, err := src.sha256Of(name, tmp)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if dst.Exists(name) {
+		current, _, err := dst.sha256Of(name, nil)
+		if err != nil {
+			return "", 0, false, err
+		}
+		if current == sum {
+			return sum, size, true, nil
+		}
+		if !overwrite {
+			return "", 0, false, fmt.Errorf("%s exists in the destination with a different content", name)
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, false, err
+	}
+	put := func(name string, r io.Reader, size int64, metadata map[string]string) error {
+		carried := map[string]string{}
+		for k, v := range info.Metadata {
+			carried[k] = v
+		}
+		delete(carried, MetadataCompression)
+		if algorithm, ok := metadata[MetadataCompression]; ok {
+			carried[MetadataCompression] = algorithm
+		}
+		return dst.backend.Put(name, r, size, carried)
+	}
+	if err := dst.archive(name, "overwrite"); err != nil {
+		return "", 0, false, err
+	}
+	if err := dst.writeWith(name, tmp, size, put); err != nil {
+		return "", 0, false, err
+	}
+	copied, _, err := dst.sha256Of(name, nil)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if copied != sum {
+		return "", 0, false, fmt.Errorf("checksum mismatch: source %s, destination %s", sum, copied)
+	}
+	return sum, size, false, nil
+}
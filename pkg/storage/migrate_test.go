@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	srcBackend := NewMemoryBackend()
+	src, err := NewData(srcBackend, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetProvenance(Provenance{Hostname: "master-1"})
+	dstBackend := NewMemoryBackend()
+	dst, err := NewData(dstBackend, &Config{Encryption: EncryptionConfig{Passphrase: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.SetProvenance(Provenance{Hostname: "laptop"})
+	files := map[string][]byte{"ca.crt": []byte("crt"), "ca.key": []byte("key")}
+	if err := src.UploadFilesFromMemory(files, "pki/etcd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.UploadFilesFromMemory(map[string][]byte{"join.sh": []byte("join")}, "join"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.UploadFilesFromMemory(map[string][]byte{"join.sh": []byte("other")}, "join"); err != nil {
+		t.Fatal(err)
+	}
+
+	internal := []string{"history/pki/vpn/ca.crl/20200101T000000.000000000Z", "pki/vpn/ca.crl" + lockSuffix, checkPrefix + "probe"}
+	for _, name := range internal {
+		if err := srcBackend.Put(name, strings.NewReader("x"), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "furyagent-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := MigrateOptions{StatePath: filepath.Join(dir, "state.json")}
+
+	report, err := Migrate(src, dst, MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Copied) != 3 || dstBackend.exists("pki/etcd/ca.crt") {
+		t.Fatalf("dry run must not copy anything: %+v", report)
+	}
+
+	report, err = Migrate(src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Copied) != 2 || len(report.Failed) != 1 || report.Failed["join/join.sh"] == nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	downloaded, err := dst.DownloadFilesToMemory([]string{"ca.key"}, "pki/etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded["ca.key"]) != "key" {
+		t.Fatalf("unexpected content %q", downloaded["ca.key"])
+	}
+	if info, err := dstBackend.Stat("pki/etcd/ca.key"); err != nil || info.Metadata[MetadataHostname] != "master-1" {
+		t.Fatalf("provenance of the source not kept: %+v %v", info, err)
+	}
+	for _, name := range internal {
+		if dstBackend.exists(name) {
+			t.Fatalf("internal object %s migrated", name)
+		}
+	}
+
+	opts.Overwrite = true
+	report, err = Migrate(src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Resumed != 2 || len(report.Copied) != 1 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report after resume %+v", report)
+	}
+}
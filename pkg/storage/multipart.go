@@ -0,0 +1,258 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/sighupio/furyagent/pkg/planner"
+)
+
+const (
+	// DefaultPartSizeMB is the multipart part size used when partSizeMB is not configured
+	DefaultPartSizeMB = 64
+	// MinPartSizeMB is the smallest part size accepted by S3 (except for the last part)
+	MinPartSizeMB = 5
+
+	multipartStateSuffix = ".upload"
+	partRetries          = 5
+)
+
+// newPartBackOff returns the retry policy of a single part upload
+var newPartBackOff = func() backoff.BackOff {
+	return backoff.WithMaxRetries(backoff.NewExponentialBackOff(), partRetries)
+}
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+// MultipartBackend is implemented by the backends able to upload an object in parts
+type MultipartBackend interface {
+	Backend
+	// CreateMultipartUpload starts a new multipart upload and returns its id
+	CreateMultipartUpload(name string, metadata map[string]string) (string, error)
+	// UploadPart uploads a part (numbered from 1) and returns its ETag
+	UploadPart(name, uploadID string, number int, data []byte) (string, error)
+	// ListParts returns the parts already uploaded
+	ListParts(name, uploadID string) ([]Part, error)
+	// CompleteMultipartUpload assembles the parts into the final object
+	CompleteMultipartUpload(name, uploadID string, parts []Part) error
+	// AbortMultipartUpload discards the upload and its parts
+	AbortMultipartUpload(name, uploadID string) error
+}
+
+// multipartState is persisted next to the local file to resume an interrupted upload
+type multipartState struct {
+	Name     string `json:"name"`
+	UploadID string `json:"uploadId"`
+	PartSize int64  `json:"partSize"`
+}
+
+func partSize(cfg *Config) (int64, error) {
+	size := cfg.PartSizeMB
+	if size == 0 {
+		size = DefaultPartSizeMB
+	}
+	if size < MinPartSizeMB {
+		return 0, fmt.Errorf("partSizeMB must be at least %d", MinPartSizeMB)
+	}
+	return size * 1024 * 1024, nil
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func loadMultipartState(statePath, filename string, partSize int64) *multipartState {
+	content, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	state := new(multipartState)
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil
+	}
+	if state.Name != filename || state.PartSize != partSize || state.UploadID == "" {
+		return nil
+	}
+	return state
+}
+
+// PendingUpload returns the object an interrupted multipart upload of localPath was
+// writing, if the upload can be resumed
+func PendingUpload(localPath string) (string, bool) {
+	content, err := ioutil.ReadFile(localPath + multipartStateSuffix)
+	if err != nil {
+		return "", false
+	}
+	state := new(multipartState)
+	if err := json.Unmarshal(content, state); err != nil || state.Name == "" {
+		return "", false
+	}
+	return state.Name, true
+}
+
+// DiscardPendingUpload forgets the interrupted multipart upload of localPath
+func DiscardPendingUpload(localPath string) error {
+	statePath := localPath + multipartStateSuffix
+	return planner.Do("remove the upload state "+statePath, func() error {
+		if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+func saveMultipartState(statePath string, state *multipartState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, content, 0600)
+}
+
+// UploadFileMultipart uploads localPath in parts when the backend supports it,
+// otherwise as a single stream. An interrupted upload is resumed on the next call:
+// its id is kept in localPath.upload and the parts whose content is already in the
+// bucket are not sent again.
+func (s *Data) UploadFileMultipart(filename, localPath string) error {
+	if s.Exists(filename) {
+		return fmt.Errorf("%s %w", filename, ErrAlreadyExists)
+	}
+	return planner.Do(fmt.Sprintf("upload %s to %s", localPath, filename), func() error {
+		return s.uploadFileMultipart(filename, localPath)
+	})
+}
+
+func (s *Data) uploadFileMultipart(filename, localPath string) error {
+	fileSize, err := FileSize(localPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mb, ok := s.backend.(MultipartBackend)
+	if !ok || fileSize <= s.partSize {
+		log.Printf("uploading %s to %s as a single stream", localPath, filename)
+		return s.put(filename, f, fileSize)
+	}
+	log.Printf("uploading %s to %s in parts of %d bytes", localPath, filename, s.partSize)
+
+	statePath := localPath + multipartStateSuffix
+	uploaded := map[int]Part{}
+	state := loadMultipartState(statePath, filename, s.partSize)
+	if state != nil {
+		parts, err := mb.ListParts(filename, state.UploadID)
+		if err != nil {
+			log.Printf("cannot resume upload %s, starting a new one: %v", state.UploadID, err)
+			state = nil
+		}
+		for _, p := range parts {
+			uploaded[p.Number] = p
+		}
+	}
+	digest := newDigester()
+	var r io.Reader = io.TeeReader(f, digest)
+	var extra map[string]string
+	if s.compressor.applies(fileSize) {
+		// compressing the same file gives the same parts, so a resumed upload still skips them
+		compressed, compressedSize, cleanup, err := s.compressor.compress(r, fileSize)
+		if err != nil {
+			return fmt.Errorf("Cannot compress item %s: %v", filename, err)
+		}
+		defer cleanup()
+		log.Printf("compressed %s with %s from %d to %d bytes", localPath, s.compressor.algorithm, fileSize, compressedSize)
+		r, fileSize = compressed, compressedSize
+		extra = map[string]string{MetadataCompression: s.compressor.algorithm}
+	}
+	if state == nil {
+		uploadID, err := mb.CreateMultipartUpload(filename, s.metadata(extra))
+		if err != nil {
+			return err
+		}
+		state = &multipartState{Name: filename, UploadID: uploadID, PartSize: s.partSize}
+		if err := saveMultipartState(statePath, state); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("resuming upload %s, %d parts already in the bucket", state.UploadID, len(uploaded))
+	}
+
+	if s.envelope != nil {
+		// a resumed encrypted upload sends every part again: a new data key never matches the old parts
+		r, _, err = s.envelope.seal(r, fileSize)
+		if err != nil {
+			return fmt.Errorf("Cannot encrypt item %s: %v", filename, err)
+		}
+	}
+	var parts []Part
+	buf := make([]byte, s.partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && number > 1 {
+			break
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		data := buf[:n]
+		sum := etag(data)
+		if p, ok := uploaded[number]; ok && strings.Trim(p.ETag, `"`) == sum && p.Size == int64(n) {
+			log.Printf("part %d of %s already uploaded", number, filename)
+			parts = append(parts, p)
+		} else {
+			var tag string
+			upload := func() error {
+				var err error
+				tag, err = mb.UploadPart(filename, state.UploadID, number, data)
+				return err
+			}
+			notify := func(err error, t time.Duration) {
+				log.Printf("failed to upload part %d of %s: %v -> will retry in %s", number, filename, err, t)
+			}
+			if err := backoff.RetryNotify(upload, newPartBackOff(), notify); err != nil {
+				return fmt.Errorf("Cannot upload part %d of %s, run the command again to resume: %w", number, filename, err)
+			}
+			log.Printf("uploaded part %d of %s [size: %d]", number, filename, n)
+			parts = append(parts, Part{Number: number, ETag: tag, Size: int64(n)})
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	if err := mb.CompleteMultipartUpload(filename, state.UploadID, parts); err != nil {
+		return err
+	}
+	os.Remove(statePath)
+	return s.updateManifest(filename, digest.entry())
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// flakyBackend fails the upload of every part numbered failFrom or more
+type flakyBackend struct {
+	*MemoryBackend
+	failFrom int
+	sent     []int
+}
+
+func (f *flakyBackend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	if f.failFrom > 0 && number >= f.failFrom {
+		return "", errors.New("connection reset by peer")
+	}
+	f.sent = append(f.sent, number)
+	return f.MemoryBackend.UploadPart(name, uploadID, number, data)
+}
+
+func TestUploadFileMultipartResume(t *testing.T) {
+	defaultPartBackOff := newPartBackOff
+	defer func() { newPartBackOff = defaultPartBackOff }()
+	newPartBackOff = func() backoff.BackOff { return &backoff.StopBackOff{} }
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	content := make([]byte, 2*MinPartSizeMB*1024*1024+123)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(snapshot, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &flakyBackend{MemoryBackend: NewMemoryBackend(), failFrom: 2}
+	store, err := NewData(backend, &Config{PartSizeMB: MinPartSizeMB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadFileMultipart("etcd/node-1/snapshot.db", snapshot); err == nil {
+		t.Fatal("expected the first upload to fail")
+	}
+	if _, err := os.Stat(snapshot + multipartStateSuffix); err != nil {
+		t.Fatalf("upload state not saved: %v", err)
+	}
+
+	backend.failFrom, backend.sent = 0, nil
+	if err := store.UploadFileMultipart("etcd/node-1/snapshot.db", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.sent) != 2 || backend.sent[0] != 2 {
+		t.Fatalf("expected only parts 2 and 3 to be sent again, sent %v", backend.sent)
+	}
+	if _, err := os.Stat(snapshot + multipartStateSuffix); !os.IsNotExist(err) {
+		t.Fatal("upload state not removed")
+	}
+	files, err := store.DownloadFilesToMemory([]string{"snapshot.db"}, "etcd/node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(files["snapshot.db"], content) {
+		t.Fatal("uploaded snapshot differs from the local one")
+	}
+	manifest, err := store.Manifest("etcd/node-1")
+	if err != nil || manifest.Files["snapshot.db"].Size != int64(len(content)) {
+		t.Fatalf("snapshot not recorded in the manifest: %+v %v", manifest, err)
+	}
+}
+
+func TestDiscardPendingUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	if err := saveMultipartState(snapshot+multipartStateSuffix, &multipartState{Name: "etcd/node-1/snapshot.db", UploadID: "upload-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := PendingUpload(snapshot); !ok || name != "etcd/node-1/snapshot.db" {
+		t.Fatalf("pending upload not found: %s", name)
+	}
+	if err := DiscardPendingUpload(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := PendingUpload(snapshot); ok {
+		t.Fatal("upload still pending after discarding it")
+	}
+}
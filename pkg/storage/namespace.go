@@ -0,0 +1,160 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ClustersPrefix is the directory holding one namespace per cluster when clusterName is set
+const ClustersPrefix = "clusters/"
+
+// rootPrefixes are the top level directories written by furyagent, used to detect
+// a cluster stored in the bucket root by a configuration without clusterName
+var rootPrefixes = []string{"pki/", "etcd/", "join/", "ssh/"}
+
+// clusterNamePattern is a DNS label, so that a clusterName like ".." cannot escape clusters/ on the local provider
+var clusterNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func clusterPrefix(clusterName string) (string, error) {
+	if !clusterNamePattern.MatchString(clusterName) {
+		return "", fmt.Errorf("clusterName %q must be a DNS label: lowercase letters, digits and dashes, at most 63 characters", clusterName)
+	}
+	return ClustersPrefix + clusterName + "/", nil
+}
+
+// prefixBackend stores every object of a Backend below a fixed prefix
+type prefixBackend struct {
+	Backend
+	prefix string
+}
+
+// prefixMultipartBackend is a prefixBackend on top of a MultipartBackend
+type prefixMultipartBackend struct {
+	prefixBackend
+	mb MultipartBackend
+}
+
+// withPrefix wraps backend so that every object name is stored below prefix
+func withPrefix(backend Backend, prefix string) Backend {
+	pb := prefixBackend{Backend: backend, prefix: prefix}
+	if mb, ok := backend.(MultipartBackend); ok {
+		return &prefixMultipartBackend{prefixBackend: pb, mb: mb}
+	}
+	return &pb
+}
+
+// Get implements Backend
+func (p *prefixBackend) Get(name string) (io.ReadCloser, error) {
+	return p.Backend.Get(p.prefix + name)
+}
+
+// Put implements Backend
+func (p *prefixBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	return p.Backend.Put(p.prefix+name, r, size, metadata)
+}
+
+// PutIfMatch implements ConditionalBackend, falling back to a lock for the backends without conditional writes
+func (p *prefixBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	return putIfMatch(p.Backend, p.prefix+name, r, size, metadata, etag)
+}
+
+// List implements Backend
+func (p *prefixBackend) List(prefix string) ([]string, error) {
+	names, err := p.Backend.List(p.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = strings.TrimPrefix(name, p.prefix)
+	}
+	return names, nil
+}
+
+// Delete implements Backend
+func (p *prefixBackend) Delete(name string) error {
+	return p.Backend.Delete(p.prefix + name)
+}
+
+// Stat implements Backend
+func (p *prefixBackend) Stat(name string) (*ObjectInfo, error) {
+	info, err := p.Backend.Stat(p.prefix + name)
+	if err != nil {
+		return nil, err
+	}
+	info.Name = strings.TrimPrefix(info.Name, p.prefix)
+	return info, nil
+}
+
+// CreateMultipartUpload implements MultipartBackend
+func (p *prefixMultipartBackend) CreateMultipartUpload(name string, metadata map[string]string) (string, error) {
+	return p.mb.CreateMultipartUpload(p.prefix+name, metadata)
+}
+
+// UploadPart implements MultipartBackend
+func (p *prefixMultipartBackend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	return p.mb.UploadPart(p.prefix+name, uploadID, number, data)
+}
+
+// ListParts implements MultipartBackend
+func (p *prefixMultipartBackend) ListParts(name, uploadID string) ([]Part, error) {
+	return p.mb.ListParts(p.prefix+name, uploadID)
+}
+
+// CompleteMultipartUpload implements MultipartBackend
+func (p *prefixMultipartBackend) CompleteMultipartUpload(name, uploadID string, parts []Part) error {
+	return p.mb.CompleteMultipartUpload(p.prefix+name, uploadID, parts)
+}
+
+// AbortMultipartUpload implements MultipartBackend
+func (p *prefixMultipartBackend) AbortMultipartUpload(name, uploadID string) error {
+	return p.mb.AbortMultipartUpload(p.prefix+name, uploadID)
+}
+
+// Clusters returns the names of the clusters stored in the bucket. A cluster
+// stored in the bucket root, without clusterName, is returned as an empty name.
+func (s *Data) Clusters() ([]string, error) {
+	names, err := s.bucket.List(ClustersPrefix)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, name := range names {
+		cluster := strings.SplitN(strings.TrimPrefix(name, ClustersPrefix), "/", 2)[0]
+		if cluster != "" {
+			found[cluster] = true
+		}
+	}
+	for _, prefix := range rootPrefixes {
+		names, err := s.bucket.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			found[""] = true
+			break
+		}
+	}
+	var clusters []string
+	for cluster := range found {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	return clusters, nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClusterNamespaces(t *testing.T) {
+	backend := NewMemoryBackend()
+	stores := map[string]*Data{}
+	for _, cluster := range []string{"", "prod", "staging"} {
+		store, err := NewData(backend, &Config{ClusterName: cluster})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{"ca.crt": []byte("ca of " + cluster)}
+		if err := store.UploadFilesFromMemory(files, "pki/etcd"); err != nil {
+			t.Fatal(err)
+		}
+		stores[cluster] = store
+	}
+	if !backend.exists("clusters/prod/pki/etcd/ca.crt") || !backend.exists("pki/etcd/ca.crt") {
+		t.Fatal("objects not stored under the cluster prefix")
+	}
+	for cluster, store := range stores {
+		files, err := store.DownloadFilesToMemory([]string{"ca.crt"}, "pki/etcd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(files["ca.crt"]) != "ca of "+cluster {
+			t.Fatalf("cluster %q read %q", cluster, files["ca.crt"])
+		}
+		listed, err := store.List("pki/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(listed, []string{"etcd/ca.crt"}) {
+			t.Fatalf("cluster %q lists %v", cluster, listed)
+		}
+	}
+	clusters, err := stores["prod"].Clusters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(clusters, []string{"", "prod", "staging"}) {
+		t.Fatalf("unexpected clusters: %v", clusters)
+	}
+	for _, name := range []string{"a/b", "..", ".", "-prod", "Prod", "prod_eu", strings.Repeat("a", 64)} {
+		if _, err := NewData(backend, &Config{ClusterName: name}); err == nil {
+			t.Fatalf("clusterName %q must be rejected", name)
+		}
+	}
+}
+
+func (m *MemoryBackend) exists(name string) bool {
+	_, err := m.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,105 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Object metadata recording who uploaded an object
+const (
+	MetadataHostname  = "hostname"
+	MetadataNodeName  = "nodename"
+	MetadataVersion   = "version"
+	MetadataCommit    = "commit"
+	MetadataCommand   = "command"
+	MetadataTimestamp = "timestamp"
+)
+
+// ProvenanceKeys lists the provenance metadata in display order
+var ProvenanceKeys = []string{MetadataTimestamp, MetadataHostname, MetadataNodeName, MetadataCommand, MetadataVersion, MetadataCommit}
+
+// Provenance describes the furyagent run uploading objects
+type Provenance struct {
+	Hostname string
+	NodeName string
+	Version  string
+	Commit   string
+	Command  string
+}
+
+// SetProvenance records p, with the upload time, in the metadata of every object
+// uploaded from now on. The hostname defaults to the one of the machine.
+func (s *Data) SetProvenance(p Provenance) {
+	if p.Hostname == "" {
+		p.Hostname, _ = os.Hostname()
+	}
+	s.provenance = &p
+}
+
+// metadata returns the metadata of an object uploaded now, extra included
+func (s *Data) metadata(extra map[string]string) map[string]string {
+	if s.provenance == nil && len(extra) == 0 {
+		return nil
+	}
+	metadata := map[string]string{}
+	if p := s.provenance; p != nil {
+		for k, v := range map[string]string{
+			MetadataHostname:  p.Hostname,
+			MetadataNodeName:  p.NodeName,
+			MetadataVersion:   p.Version,
+			MetadataCommit:    p.Commit,
+			MetadataCommand:   p.Command,
+			MetadataTimestamp: time.Now().UTC().Format(time.RFC3339),
+		} {
+			if v != "" {
+				metadata[k] = encodeMetadata(v)
+			}
+		}
+	}
+	for k, v := range extra {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+// encodeMetadata percent-encodes the bytes of v that S3 and Azure do not accept in
+// a header value: control characters, non-ASCII characters and % itself
+func encodeMetadata(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c >= 0x7f || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// DecodeMetadata returns the provenance value v as it was before being stored.
+// Values that are not valid percent-encoding are returned unchanged.
+func DecodeMetadata(v string) string {
+	decoded, err := url.PathUnescape(v)
+	if err != nil {
+		return v
+	}
+	return decoded
+}
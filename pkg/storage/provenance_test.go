@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	store, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetProvenance(Provenance{NodeName: "master-1", Version: "v1.0.0", Commit: "abc123", Command: "furyagent init master"})
+	if err := store.UploadFilesFromMemory(map[string][]byte{"ca.crt": []byte("crt")}, "pki/master"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pki/master/ca.crt", "pki/master/" + ManifestFile} {
+		info, err := store.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := info.Metadata
+		if md[MetadataNodeName] != "master-1" || md[MetadataCommand] != "furyagent init master" ||
+			md[MetadataVersion] != "v1.0.0" || md[MetadataCommit] != "abc123" || md[MetadataHostname] == "" {
+			t.Fatalf("unexpected metadata of %s: %v", name, md)
+		}
+		if _, err := time.Parse(time.RFC3339, md[MetadataTimestamp]); err != nil {
+			t.Fatalf("invalid timestamp of %s: %v", name, err)
+		}
+	}
+}
+
+func TestProvenanceEncodesCommand(t *testing.T) {
+	store, err := NewData(NewMemoryBackend(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	command := "furyagent storage put rapport-été.pdf\n100%"
+	store.SetProvenance(Provenance{NodeName: "master-1", Command: command})
+	if err := store.UploadFilesFromMemory(map[string][]byte{"ca.crt": []byte("crt")}, "pki/master"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat("pki/master/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := info.Metadata[MetadataCommand]
+	for _, c := range []byte(stored) {
+		if c < 0x20 || c >= 0x7f {
+			t.Fatalf("stored command %q is not printable ASCII", stored)
+		}
+	}
+	if got := DecodeMetadata(stored); got != command {
+		t.Fatalf("expected %q after decoding, got %q", command, got)
+	}
+	if got := DecodeMetadata("furyagent init master"); got != "furyagent init master" {
+		t.Fatalf("plain values must decode to themselves, got %q", got)
+	}
+}
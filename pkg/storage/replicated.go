@@ -0,0 +1,583 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spoolMemoryLimit is the biggest object kept in memory while it is replicated, bigger ones go to a temporary file
+	spoolMemoryLimit = 32 * 1024 * 1024
+	// replicaRetryInterval is how long a replica that cannot be initialized is skipped before trying again
+	replicaRetryInterval = time.Minute
+)
+
+// errNoMultipart is returned by the replicas whose provider cannot upload in parts
+var errNoMultipart = errors.New("multipart uploads are not supported by the provider")
+
+// multipartProviders are the providers whose Backend implements MultipartBackend
+var multipartProviders = map[string]bool{"s3": true, "memory": true}
+
+// replicatedBackend writes every object to all its backends and reads from the first one that answers
+type replicatedBackend struct {
+	backends []Backend
+	names    []string
+	quorum   int
+	// multipart is set when any replica can upload in parts
+	multipart bool
+}
+
+func newReplicatedBackend(cfg *Config) (*replicatedBackend, error) {
+	r := new(replicatedBackend)
+	configs := append([]Config{*cfg}, cfg.Replicas...)
+	var initErr error
+	available := 0
+	for i := range configs {
+		c := configs[i]
+		if i > 0 && len(c.Replicas) > 0 {
+			return nil, fmt.Errorf("replica %s cannot have replicas", c.Provider)
+		}
+		c.Replicas = nil
+		name := fmt.Sprintf("%s[%d]", c.Provider, i)
+		// a replica in an outage must not prevent using the others
+		backend := &lazyBackend{cfg: c}
+		if _, err := backend.get(); err != nil {
+			log.Printf("replica %s is unavailable, it is skipped until it answers: %v", name, err)
+			if initErr == nil {
+				initErr = fmt.Errorf("Cannot initialize replica %d (%s): %w", i, c.Provider, err)
+			}
+		} else {
+			available++
+		}
+		r.backends = append(r.backends, backend)
+		r.names = append(r.names, name)
+		r.multipart = r.multipart || multipartProviders[c.Provider]
+	}
+	if available == 0 {
+		return nil, initErr
+	}
+	r.quorum = cfg.WriteQuorum
+	if r.quorum == 0 {
+		r.quorum = len(r.backends)
+	}
+	if r.quorum < 1 || r.quorum > len(r.backends) {
+		return nil, fmt.Errorf("writeQuorum must be between 1 and %d", len(r.backends))
+	}
+	return r, nil
+}
+
+// spool makes r readable once per backend
+func spool(r io.Reader, size int64) (func() (io.Reader, error), func(), error) {
+	if size <= spoolMemoryLimit {
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func() (io.Reader, error) { return bytes.NewReader(content), nil }, func() {}, nil
+	}
+	f, err := ioutil.TempFile("", "furyagent-replica")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	open := func() (io.Reader, error) {
+		_, err := f.Seek(0, io.SeekStart)
+		return f, err
+	}
+	return open, cleanup, nil
+}
+
+// write runs op on every backend and succeeds if at least quorum of them did
+func (r *replicatedBackend) write(what string, op func(Backend) error) error {
+	return r.writeEach(what, func(_ int, backend Backend) error {
+		return op(backend)
+	})
+}
+
+// writeEach is write passing to op the index of the backend
+func (r *replicatedBackend) writeEach(what string, op func(int, Backend) error) error {
+	var failures []string
+	notFound := 0
+	for i, backend := range r.backends {
+		err := op(i, backend)
+		if err == ErrNotFound {
+			notFound++
+		} else if err != nil {
+			log.Printf("%s failed on %s: %v", what, r.names[i], err)
+			failures = append(failures, fmt.Sprintf("%s: %v", r.names[i], err))
+		}
+	}
+	if notFound == len(r.backends) {
+		return ErrNotFound
+	}
+	if ok := len(r.backends) - len(failures); ok < r.quorum {
+		return fmt.Errorf("%s succeeded on %d backends, quorum is %d: %s", what, ok, r.quorum, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// read returns the result of the first backend on which op succeeds
+func (r *replicatedBackend) read(what string, op func(Backend) error) error {
+	var err error
+	notFound := 0
+	for i, backend := range r.backends {
+		if err = op(backend); err == nil {
+			return nil
+		} else if err == ErrNotFound {
+			notFound++
+		} else {
+			log.Printf("%s failed on %s, trying the next backend: %v", what, r.names[i], err)
+		}
+	}
+	if notFound == len(r.backends) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Get implements Backend
+func (r *replicatedBackend) Get(name string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := r.read("get "+name, func(b Backend) error {
+		var err error
+		reader, err = b.Get(name)
+		return err
+	})
+	return reader, err
+}
+
+// Put implements Backend
+func (r *replicatedBackend) Put(name string, obj io.Reader, size int64, metadata map[string]string) error {
+	open, cleanup, err := spool(obj, size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return r.write("put "+name, func(b Backend) error {
+		reader, err := open()
+		if err != nil {
+			return err
+		}
+		return b.Put(name, reader, size, metadata)
+	})
+}
+
+// PutIfMatch implements ConditionalBackend. etag is the one of the first replica answering
+// Stat, which is written first and detects the conflicts; the other replicas are then
+// written like Put, and the write succeeds if at least quorum of them did.
+func (r *replicatedBackend) PutIfMatch(name string, obj io.Reader, size int64, metadata map[string]string, etag string) error {
+	open, cleanup, err := spool(obj, size)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	first := -1
+	for i, backend := range r.backends {
+		if _, err := backend.Stat(name); err == nil || err == ErrNotFound {
+			first = i
+			break
+		} else {
+			log.Printf("stat %s failed on %s, trying the next backend: %v", name, r.names[i], err)
+		}
+	}
+	if first < 0 {
+		return fmt.Errorf("Cannot write %s: no replica answers", name)
+	}
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	if err := putIfMatch(r.backends[first], name, reader, size, metadata, etag); err != nil {
+		return err
+	}
+	return r.writeEach("put "+name, func(i int, b Backend) error {
+		if i == first {
+			return nil
+		}
+		reader, err := open()
+		if err != nil {
+			return err
+		}
+		return b.Put(name, reader, size, metadata)
+	})
+}
+
+// List implements Backend
+func (r *replicatedBackend) List(prefix string) ([]string, error) {
+	var names []string
+	err := r.read("list "+prefix, func(b Backend) error {
+		var err error
+		names, err = b.List(prefix)
+		return err
+	})
+	return names, err
+}
+
+// Delete implements Backend
+func (r *replicatedBackend) Delete(name string) error {
+	return r.write("delete "+name, func(b Backend) error {
+		return b.Delete(name)
+	})
+}
+
+// Stat implements Backend
+func (r *replicatedBackend) Stat(name string) (*ObjectInfo, error) {
+	var info *ObjectInfo
+	err := r.read("stat "+name, func(b Backend) error {
+		var err error
+		info, err = b.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+// Close implements Backend
+func (r *replicatedBackend) Close() error {
+	var err error
+	for _, backend := range r.backends {
+		if e := backend.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// replicatedMultipartBackend uploads in parts to the replicas supporting it and copies the
+// completed object to the other ones. Its upload id holds the id of the upload on every
+// replica, empty for the replicas not taking part in it.
+type replicatedMultipartBackend struct {
+	*replicatedBackend
+}
+
+func (r *replicatedMultipartBackend) uploadIDs(uploadID string) ([]string, error) {
+	var ids []string
+	if err := json.Unmarshal([]byte(uploadID), &ids); err != nil || len(ids) != len(r.backends) {
+		return nil, fmt.Errorf("invalid replicated upload id %s", uploadID)
+	}
+	return ids, nil
+}
+
+// CreateMultipartUpload implements MultipartBackend
+func (r *replicatedMultipartBackend) CreateMultipartUpload(name string, metadata map[string]string) (string, error) {
+	ids := make([]string, len(r.backends))
+	started := 0
+	for i, backend := range r.backends {
+		mb, ok := backend.(MultipartBackend)
+		if !ok {
+			continue
+		}
+		id, err := mb.CreateMultipartUpload(name, metadata)
+		if err != nil {
+			log.Printf("multipart upload of %s not started on %s, the object is copied there once complete: %v", name, r.names[i], err)
+			continue
+		}
+		ids[i] = id
+		started++
+	}
+	if started == 0 {
+		return "", fmt.Errorf("Cannot start the multipart upload of %s on any replica", name)
+	}
+	id, err := json.Marshal(ids)
+	return string(id), err
+}
+
+// UploadPart implements MultipartBackend. A replica missing a part gets a copy of the
+// object instead once the upload is complete.
+func (r *replicatedMultipartBackend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	ids, err := r.uploadIDs(uploadID)
+	if err != nil {
+		return "", err
+	}
+	uploaded := 0
+	for i, backend := range r.backends {
+		if ids[i] == "" {
+			continue
+		}
+		if _, err = backend.(MultipartBackend).UploadPart(name, ids[i], number, data); err != nil {
+			log.Printf("upload of part %d of %s failed on %s: %v", number, name, r.names[i], err)
+			continue
+		}
+		uploaded++
+	}
+	if uploaded == 0 {
+		return "", err
+	}
+	return etag(data), nil
+}
+
+// ListParts implements MultipartBackend, with the parts of the first replica that answers
+func (r *replicatedMultipartBackend) ListParts(name, uploadID string) ([]Part, error) {
+	ids, err := r.uploadIDs(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	for i, backend := range r.backends {
+		if ids[i] == "" {
+			continue
+		}
+		var parts []Part
+		if parts, err = backend.(MultipartBackend).ListParts(name, ids[i]); err == nil {
+			return parts, nil
+		}
+		log.Printf("list parts of %s failed on %s, trying the next backend: %v", name, r.names[i], err)
+	}
+	return nil, err
+}
+
+// CompleteMultipartUpload implements MultipartBackend. The replicas that could not complete
+// the upload receive a copy of the object from the first one that did.
+func (r *replicatedMultipartBackend) CompleteMultipartUpload(name, uploadID string, parts []Part) error {
+	ids, err := r.uploadIDs(uploadID)
+	if err != nil {
+		return err
+	}
+	completed := make([]bool, len(r.backends))
+	source := -1
+	for i, backend := range r.backends {
+		if ids[i] == "" {
+			continue
+		}
+		mb := backend.(MultipartBackend)
+		if err := completeReplica(mb, name, ids[i], parts); err != nil {
+			log.Printf("multipart upload of %s not completed on %s, copying the object there: %v", name, r.names[i], err)
+			mb.AbortMultipartUpload(name, ids[i])
+			continue
+		}
+		completed[i] = true
+		if source < 0 {
+			source = i
+		}
+	}
+	if source < 0 {
+		return fmt.Errorf("Cannot complete the multipart upload of %s on any replica", name)
+	}
+	info, err := r.backends[source].Stat(name)
+	if err != nil {
+		return err
+	}
+	return r.writeEach("copy "+name, func(i int, b Backend) error {
+		if completed[i] {
+			return nil
+		}
+		reader, err := r.backends[source].Get(name)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return b.Put(name, reader, info.Size, info.Metadata)
+	})
+}
+
+// completeReplica completes the upload on mb if it received every part
+func completeReplica(mb MultipartBackend, name, uploadID string, parts []Part) error {
+	uploaded, err := mb.ListParts(name, uploadID)
+	if err != nil {
+		return err
+	}
+	byNumber := map[int]Part{}
+	for _, p := range uploaded {
+		byNumber[p.Number] = p
+	}
+	replicaParts := make([]Part, len(parts))
+	for i, p := range parts {
+		u, ok := byNumber[p.Number]
+		if !ok || u.Size != p.Size || strings.Trim(u.ETag, `"`) != strings.Trim(p.ETag, `"`) {
+			return fmt.Errorf("part %d is missing", p.Number)
+		}
+		replicaParts[i] = u
+	}
+	return mb.CompleteMultipartUpload(name, uploadID, replicaParts)
+}
+
+// AbortMultipartUpload implements MultipartBackend
+func (r *replicatedMultipartBackend) AbortMultipartUpload(name, uploadID string) error {
+	ids, err := r.uploadIDs(uploadID)
+	if err != nil {
+		return err
+	}
+	return r.writeEach("abort "+name, func(i int, b Backend) error {
+		if ids[i] == "" {
+			return nil
+		}
+		return b.(MultipartBackend).AbortMultipartUpload(name, ids[i])
+	})
+}
+
+// lazyBackend initializes a replica on first use, and again at most every
+// replicaRetryInterval while its initialization fails
+type lazyBackend struct {
+	cfg     Config
+	mu      sync.Mutex
+	backend Backend
+	err     error
+	failed  time.Time
+}
+
+func (l *lazyBackend) get() (Backend, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backend != nil {
+		return l.backend, nil
+	}
+	if l.err != nil && time.Since(l.failed) < replicaRetryInterval {
+		return nil, l.err
+	}
+	backend, err := newBackend(&l.cfg)
+	if err != nil {
+		l.err = fmt.Errorf("replica unavailable: %w", err)
+		l.failed = time.Now()
+		return nil, l.err
+	}
+	l.backend, l.err = backend, nil
+	return backend, nil
+}
+
+// Get implements Backend
+func (l *lazyBackend) Get(name string) (io.ReadCloser, error) {
+	backend, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Get(name)
+}
+
+// Put implements Backend
+func (l *lazyBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	backend, err := l.get()
+	if err != nil {
+		return err
+	}
+	return backend.Put(name, r, size, metadata)
+}
+
+// PutIfMatch implements ConditionalBackend
+func (l *lazyBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	backend, err := l.get()
+	if err != nil {
+		return err
+	}
+	return putIfMatch(backend, name, r, size, metadata, etag)
+}
+
+// List implements Backend
+func (l *lazyBackend) List(prefix string) ([]string, error) {
+	backend, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.List(prefix)
+}
+
+// Delete implements Backend
+func (l *lazyBackend) Delete(name string) error {
+	backend, err := l.get()
+	if err != nil {
+		return err
+	}
+	return backend.Delete(name)
+}
+
+// Stat implements Backend
+func (l *lazyBackend) Stat(name string) (*ObjectInfo, error) {
+	backend, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return backend.Stat(name)
+}
+
+// Close implements Backend
+func (l *lazyBackend) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backend == nil {
+		return nil
+	}
+	return l.backend.Close()
+}
+
+func (l *lazyBackend) multipart() (MultipartBackend, error) {
+	backend, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	if mb, ok := backend.(MultipartBackend); ok {
+		return mb, nil
+	}
+	return nil, errNoMultipart
+}
+
+// CreateMultipartUpload implements MultipartBackend
+func (l *lazyBackend) CreateMultipartUpload(name string, metadata map[string]string) (string, error) {
+	mb, err := l.multipart()
+	if err != nil {
+		return "", err
+	}
+	return mb.CreateMultipartUpload(name, metadata)
+}
+
+// UploadPart implements MultipartBackend
+func (l *lazyBackend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	mb, err := l.multipart()
+	if err != nil {
+		return "", err
+	}
+	return mb.UploadPart(name, uploadID, number, data)
+}
+
+// ListParts implements MultipartBackend
+func (l *lazyBackend) ListParts(name, uploadID string) ([]Part, error) {
+	mb, err := l.multipart()
+	if err != nil {
+		return nil, err
+	}
+	return mb.ListParts(name, uploadID)
+}
+
+// CompleteMultipartUpload implements MultipartBackend
+func (l *lazyBackend) CompleteMultipartUpload(name, uploadID string, parts []Part) error {
+	mb, err := l.multipart()
+	if err != nil {
+		return err
+	}
+	return mb.CompleteMultipartUpload(name, uploadID, parts)
+}
+
+// AbortMultipartUpload implements MultipartBackend
+func (l *lazyBackend) AbortMultipartUpload(name, uploadID string) error {
+	mb, err := l.multipart()
+	if err != nil {
+		return err
+	}
+	return mb.AbortMultipartUpload(name, uploadID)
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	backoff "github.com/cenkalti/backoff/v4"
+)
+
+// unreachableBackend fails every operation like a backend in a region outage
+type unreachableBackend struct {
+	*MemoryBackend
+	down bool
+}
+
+var errUnreachable = errors.New("dial tcp: i/o timeout")
+
+func (u *unreachableBackend) Get(name string) (io.ReadCloser, error) {
+	if u.down {
+		return nil, errUnreachable
+	}
+	return u.MemoryBackend.Get(name)
+}
+
+func (u *unreachableBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	if u.down {
+		return errUnreachable
+	}
+	return u.MemoryBackend.Put(name, r, size, metadata)
+}
+
+func (u *unreachableBackend) Stat(name string) (*ObjectInfo, error) {
+	if u.down {
+		return nil, errUnreachable
+	}
+	return u.MemoryBackend.Stat(name)
+}
+
+func TestReplicatedBackend(t *testing.T) {
+	primary := &unreachableBackend{MemoryBackend: NewMemoryBackend()}
+	secondary := &unreachableBackend{MemoryBackend: NewMemoryBackend()}
+	replicated := &replicatedBackend{
+		backends: []Backend{primary, secondary},
+		names:    []string{"primary", "secondary"},
+		quorum:   2,
+	}
+	store, err := NewData(replicated, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"join.sh": []byte("kubeadm join")}
+	if err := store.UploadFilesFromMemory(files, "join"); err != nil {
+		t.Fatal(err)
+	}
+	if !primary.exists("join/join.sh") || !secondary.exists("join/join.sh") {
+		t.Fatal("object not written to every backend")
+	}
+
+	primary.down = true
+	downloaded, err := store.DownloadFilesToMemory([]string{"join.sh"}, "join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded["join.sh"]) != "kubeadm join" {
+		t.Fatalf("unexpected content %q", downloaded["join.sh"])
+	}
+	if err := store.UploadForce("join/other.sh", 0, nopReadCloser("")); err == nil {
+		t.Fatal("write must fail when the quorum is not reached")
+	}
+	replicated.quorum = 1
+	if err := store.UploadForce("join/other.sh", 0, nopReadCloser("")); err != nil {
+		t.Fatalf("write must succeed with a quorum of 1: %v", err)
+	}
+
+	if _, err := newReplicatedBackend(&Config{Provider: "memory", Replicas: []Config{{Provider: "memory"}}, WriteQuorum: 3}); err == nil {
+		t.Fatal("a quorum bigger than the number of backends must be rejected")
+	}
+}
+
+func TestInitWithUnreachablePrimary(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	cfg := &Config{
+		Provider: "s3", URL: url, BucketName: "furyagent", AccessKey: "key", SecretKey: "secret",
+		Replicas:    []Config{{Provider: "memory"}},
+		WriteQuorum: 1,
+	}
+	store, err := Init(cfg)
+	if err != nil {
+		t.Fatalf("an unreachable primary must not prevent using the replicas: %v", err)
+	}
+	if _, ok := store.backend.(MultipartBackend); !ok {
+		t.Fatal("replicas able to upload in parts must give a MultipartBackend")
+	}
+	if err := store.UploadFilesFromMemory(map[string][]byte{"join.sh": []byte("kubeadm join")}, "join"); err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := store.DownloadFilesToMemory([]string{"join.sh"}, "join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded["join.sh"]) != "kubeadm join" {
+		t.Fatalf("unexpected content %q", downloaded["join.sh"])
+	}
+
+	cfg.WriteQuorum = 2
+	store, err = Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadForce("join/join.sh", 0, nopReadCloser("")); err == nil {
+		t.Fatal("an unavailable replica must count as a failed write")
+	}
+
+	cfg.Replicas = []Config{{Provider: "s3", URL: url, BucketName: "furyagent", AccessKey: "key", SecretKey: "secret"}}
+	if _, err := Init(cfg); err == nil {
+		t.Fatal("Init must fail when no replica is available")
+	}
+}
+
+func TestReplicatedPutIfMatch(t *testing.T) {
+	primary, secondary := NewMemoryBackend(), NewMemoryBackend()
+	replicated := &replicatedBackend{backends: []Backend{primary, secondary}, names: []string{"primary", "secondary"}, quorum: 2}
+	if err := replicated.PutIfMatch("ca.crl", strings.NewReader("v1"), 2, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	info, err := replicated.Stat("ca.crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replicated.PutIfMatch("ca.crl", strings.NewReader("v2"), 2, nil, ""); err != ErrConflict {
+		t.Fatalf("expected a conflict creating an existing object, got %v", err)
+	}
+	if err := replicated.PutIfMatch("ca.crl", strings.NewReader("v2"), 2, nil, info.ETag); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicated.PutIfMatch("ca.crl", strings.NewReader("v3"), 2, nil, info.ETag); err != ErrConflict {
+		t.Fatalf("expected a conflict with a stale etag, got %v", err)
+	}
+	for _, backend := range []*MemoryBackend{primary, secondary} {
+		if info, err := backend.Stat("ca.crl"); err != nil || info.ETag != etag([]byte("v2")) {
+			t.Fatalf("replica not updated: %+v %v", info, err)
+		}
+	}
+}
+
+func TestReplicatedMultipart(t *testing.T) {
+	defaultPartBackOff := newPartBackOff
+	defer func() { newPartBackOff = defaultPartBackOff }()
+	newPartBackOff = func() backoff.BackOff { return &backoff.StopBackOff{} }
+	dir, err := ioutil.TempDir("", "furyagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.db")
+	content := make([]byte, 2*MinPartSizeMB*1024*1024+123)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(snapshot, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := &flakyBackend{MemoryBackend: NewMemoryBackend(), failFrom: 2}
+	secondary := &flakyBackend{MemoryBackend: NewMemoryBackend(), failFrom: 2}
+	// a provider without multipart uploads gets a copy of the completed object
+	single := struct{ Backend }{NewMemoryBackend()}
+	replicated := &replicatedMultipartBackend{&replicatedBackend{
+		backends: []Backend{primary, secondary, single},
+		names:    []string{"primary", "secondary", "single"},
+		quorum:   3,
+	}}
+	store, err := NewData(replicated, &Config{PartSizeMB: MinPartSizeMB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UploadFileMultipart("etcd/node-1/snapshot.db", snapshot); err == nil {
+		t.Fatal("expected the first upload to fail")
+	}
+
+	primary.failFrom, primary.sent = 0, nil
+	secondary.failFrom, secondary.sent = 0, nil
+	if err := store.UploadFileMultipart("etcd/node-1/snapshot.db", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.sent) != 2 || len(secondary.sent) != 2 {
+		t.Fatalf("expected only parts 2 and 3 to be sent again, sent %v and %v", primary.sent, secondary.sent)
+	}
+	for i, backend := range replicated.backends {
+		r, err := backend.Get("etcd/node-1/snapshot.db")
+		if err != nil {
+			t.Fatalf("%s: %v", replicated.names[i], err)
+		}
+		uploaded, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(uploaded, content) {
+			t.Fatalf("%s holds a different snapshot", replicated.names[i])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Backend implements Backend and MultipartBackend with the AWS SDK
+type s3Backend struct {
+	client *s3.S3
+	bucket string
+}
+
+func newS3Backend(cfg *Config) (*s3Backend, error) {
+	creds, err := awsCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	awsConfig := aws.NewConfig().WithCredentials(creds)
+	if cfg.Region != "" {
+		awsConfig.WithRegion(cfg.Region)
+	} else {
+		awsConfig.WithRegion("us-east-1")
+	}
+	if cfg.URL != "" {
+		awsConfig.WithEndpoint(cfg.URL).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Backend{client: s3.New(sess), bucket: cfg.BucketName}
+	if err := s.createBucket(aws.StringValue(awsConfig.Region)); err != nil {
+		return nil, fmt.Errorf("Cannot get container %s: %w", cfg.BucketName, err)
+	}
+	return s, nil
+}
+
+func (s *s3Backend) createBucket(region string) error {
+	_, err := s.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	if err == nil {
+		return nil
+	} else if !isS3NotFound(err) {
+		return s3Error(err)
+	}
+	log.Println("Container not found, trying to create one!")
+	input := &s3.CreateBucketInput{Bucket: aws.String(s.bucket)}
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(region)}
+	}
+	_, err = s.client.CreateBucket(input)
+	return s3Error(err)
+}
+
+func isS3NotFound(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+// s3Error maps the S3 errors to the errors of the Backend interface
+func s3Error(err error) error {
+	if isS3NotFound(err) {
+		return ErrNotFound
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusForbidden {
+		return fmt.Errorf("%w: %v", ErrPermission, err)
+	}
+	return err
+}
+
+// Get implements Backend
+func (s *s3Backend) Get(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return out.Body, nil
+}
+
+// Put implements Backend
+func (s *s3Backend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	out, err := s3manager.NewUploaderWithClient(s.client).Upload(&s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(name),
+		Body:     r,
+		Metadata: awsMetadata(metadata),
+	})
+	if err != nil {
+		return s3Error(err)
+	}
+	log.Println("Item URL: ", out.Location)
+	return nil
+}
+
+// List implements Backend
+func (s *s3Backend) List(prefix string) ([]string, error) {
+	var names []string
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements Backend
+func (s *s3Backend) Delete(name string) error {
+	// S3 does not fail deleting a missing key
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	return s3Error(err)
+}
+
+// Stat implements Backend
+func (s *s3Backend) Stat(name string) (*ObjectInfo, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	metadata := map[string]string{}
+	for k, v := range out.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return &ObjectInfo{
+		Name:         name,
+		Size:         aws.Int64Value(out.ContentLength),
+		ETag:         aws.StringValue(out.ETag),
+		LastModified: aws.TimeValue(out.LastModified),
+		Metadata:     metadata,
+	}, nil
+}
+
+// Close implements Backend
+func (s *s3Backend) Close() error {
+	return nil
+}
+
+func awsMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	md := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		md[k] = aws.String(v)
+	}
+	return md
+}
+
+// PutIfMatch implements ConditionalBackend with the If-Match and If-None-Match headers of PutObject
+func (s *s3Backend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) != size {
+		return fmt.Errorf("bad size for %s: expected %d bytes, got %d", name, size, len(content))
+	}
+	req, _ := s.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(name),
+		Body:     bytes.NewReader(content),
+		Metadata: awsMetadata(metadata),
+	})
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+	err = req.Send()
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return ErrConflict
+		}
+	}
+	return err
+}
+
+// CreateMultipartUpload implements MultipartBackend
+func (s *s3Backend) CreateMultipartUpload(name string, metadata map[string]string) (string, error) {
+	out, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(name),
+		Metadata: awsMetadata(metadata),
+	})
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return aws.StringValue(out.UploadId), nil
+}
+
+// UploadPart implements MultipartBackend
+func (s *s3Backend) UploadPart(name, uploadID string, number int, data []byte) (string, error) {
+	out, err := s.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(name),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(int64(number)),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// ListParts implements MultipartBackend
+func (s *s3Backend) ListParts(name, uploadID string) ([]Part, error) {
+	var parts []Part
+	err := s.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(name),
+		UploadId: aws.String(uploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts = append(parts, Part{
+				Number: int(aws.Int64Value(p.PartNumber)),
+				ETag:   aws.StringValue(p.ETag),
+				Size:   aws.Int64Value(p.Size),
+			})
+		}
+		return true
+	})
+	return parts, s3Error(err)
+}
+
+// CompleteMultipartUpload implements MultipartBackend
+func (s *s3Backend) CompleteMultipartUpload(name, uploadID string, parts []Part) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(int64(p.Number)),
+		}
+	}
+	_, err := s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(name),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return s3Error(err)
+}
+
+// AbortMultipartUpload implements MultipartBackend
+func (s *s3Backend) AbortMultipartUpload(name, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(name),
+		UploadId: aws.String(uploadID),
+	})
+	return s3Error(err)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// forbiddenS3 returns a server answering 403 to every request, like a bucket the credentials cannot access
+func forbiddenS3() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+}
+
+func TestS3Forbidden(t *testing.T) {
+	server := forbiddenS3()
+	defer server.Close()
+	_, err := Init(&Config{Provider: "s3", URL: server.URL, BucketName: "furyagent", AccessKey: "key", SecretKey: "secret"})
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+}
+
+func TestS3MultipartForbidden(t *testing.T) {
+	server := forbiddenS3()
+	defer server.Close()
+	sess, err := session.NewSession(aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("key", "secret", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &s3Backend{client: s3.New(sess), bucket: "furyagent"}
+	_, createErr := backend.CreateMultipartUpload("etcd/snapshot.db", nil)
+	_, uploadErr := backend.UploadPart("etcd/snapshot.db", "upload", 1, []byte("part"))
+	_, listErr := backend.ListParts("etcd/snapshot.db", "upload")
+	for name, err := range map[string]error{
+		"create":   createErr,
+		"upload":   uploadErr,
+		"list":     listErr,
+		"complete": backend.CompleteMultipartUpload("etcd/snapshot.db", "upload", []Part{{Number: 1, ETag: "etag"}}),
+		"abort":    backend.AbortMultipartUpload("etcd/snapshot.db", "upload"),
+	} {
+		if !errors.Is(err, ErrPermission) {
+			t.Errorf("%s: expected ErrPermission, got %v", name, err)
+		}
+	}
+}
@@ -22,13 +22,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
-	"github.com/graymeta/stow"
-	"github.com/graymeta/stow/azure"
-	"github.com/graymeta/stow/google"
-	"github.com/graymeta/stow/local"
-	"github.com/graymeta/stow/s3"
+	"github.com/sighupio/furyagent/pkg/planner"
 )
 
 type bufferWriteCloser struct {
@@ -43,114 +41,116 @@ func (bwc bufferWriteCloser) Close() error {
 	return nil
 }
 
+type teeWriteCloser struct {
+	io.Writer
+	io.Closer
+}
+
 // Data represent where to put whatever you're downloading
 type Data struct {
-	location      stow.Location
-	containerName string
-	container     stow.Container
+	// bucket is the whole bucket, backend is the part of it reserved to the configured cluster
+	bucket          Backend
+	backend         Backend
+	envelope        *envelope
+	compressor      *compressor
+	provenance      *Provenance
+	cache           *cache
+	requireManifest bool
+	partSize        int64
+	concurrency     int
+	manifestLocks   *keyedMutex
 }
 
-// Init tests the credentials, the write access and list access
+// Init connects to the configured provider: it resolves the credentials and, depending
+// on the provider, checks that the bucket exists or creates it. It does not test the
+// permissions on the objects, Check does.
+// With cache.enabled, downloads are cached in cache.dir or DefaultCacheDir.
 func Init(cfg *Config) (*Data, error) {
-	s := new(Data)
-
-	config := stow.ConfigMap{}
-	switch cfg.Provider {
-	case "s3":
-		s.containerName = cfg.BucketName
-		if cfg.URL != "" {
-			config = stow.ConfigMap{
-				s3.ConfigAccessKeyID: cfg.AccessKey,
-				s3.ConfigSecretKey:   cfg.SecretKey,
-				s3.ConfigEndpoint:    cfg.URL,
-				s3.ConfigRegion:      cfg.Region,
-			}
-		} else {
-			config = stow.ConfigMap{
-				s3.ConfigAccessKeyID: cfg.AccessKey,
-				s3.ConfigSecretKey:   cfg.SecretKey,
-				s3.ConfigRegion:      cfg.Region,
-			}
-		}
-	case "azure":
-		s.containerName = cfg.BucketName
-		config = stow.ConfigMap{
-			azure.ConfigAccount: cfg.AzureStorageAccount,
-			azure.ConfigKey:     cfg.AzureStorageKey,
-		}
-	case "google":
-		s.containerName = cfg.BucketName
-		sa, err := ioutil.ReadFile(cfg.GoogleServiceAccount)
-		if err != nil {
-			return nil, fmt.Errorf("Cannot read Google Service Account file %s: %v", cfg.GoogleServiceAccount, err)
-		}
-		config = stow.ConfigMap{
-			google.ConfigJSON:      string(sa),
-			google.ConfigProjectId: cfg.GoogleProjectId,
-		}
-	case "local":
-		config = stow.ConfigMap{
-			local.ConfigKeyPath: cfg.LocalPath,
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	withCache := *cfg
+	if !cfg.Cache.Enabled || cfg.Cache.Disabled {
+		withCache.Cache.Dir = ""
+	} else if cfg.Cache.Dir == "" {
+		if withCache.Cache.Dir, err = DefaultCacheDir(); err != nil {
+			log.Printf("cache disabled: %v", err)
 		}
-		s.containerName = cfg.LocalPath
-	default:
-		return nil, fmt.Errorf("provider \"%s\" not supported", cfg.Provider)
 	}
-	location, err := stow.Dial(cfg.Provider, config)
+	return NewData(backend, &withCache)
+}
+
+// NewData builds a Data on top of an already initialized Backend
+func NewData(backend Backend, cfg *Config) (*Data, error) {
+	envelope, err := newEnvelope(cfg.Encryption)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot dial to %s: %v", cfg.Provider, err)
+		return nil, err
 	}
-	s.location = location
-	container, err := s.getContainer()
+	compressor, err := newCompressor(cfg.Compression)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot get container %s: %v", s.containerName, err)
+		return nil, err
 	}
-	s.container = container
-	return s, nil
-}
-
-func (s *Data) getContainer() (stow.Container, error) {
-	container, err := s.location.Container(s.containerName)
-	if err == stow.ErrNotFound {
-		log.Println("Container not found, trying to create one!")
-		container, err = s.location.CreateContainer(s.containerName)
+	partSize, err := partSize(cfg)
+	if err != nil {
+		return nil, err
+	}
+	bucket := backend
+	if cfg.ClusterName != "" {
+		prefix, err := clusterPrefix(cfg.ClusterName)
 		if err != nil {
 			return nil, err
 		}
-	} else if err != nil {
-		log.Println("Generic error accessing the container: ", s.containerName)
-		return nil, err
+		backend = withPrefix(backend, prefix)
 	}
-
-	return container, nil
+	return &Data{
+		bucket:          bucket,
+		backend:         backend,
+		envelope:        envelope,
+		compressor:      compressor,
+		cache:           newCache(cfg),
+		requireManifest: cfg.RequireManifest,
+		concurrency:     cfg.Concurrency,
+		manifestLocks:   newKeyedMutex(),
+		partSize:        partSize,
+	}, nil
 }
 
-// Close closes the open connection to the remote or local stow.Location
+// Close closes the open connection to the remote or local Backend
 func (s *Data) Close() error {
-	return s.location.Close()
+	return s.backend.Close()
 }
 
 // Download is the single interface to download something from Object Storage
 func (s *Data) Download(filename string, obj io.WriteCloser) error {
-	item, err := s.container.Item(filename)
-	if err == stow.ErrNotFound {
-		return fmt.Errorf("Item %s not found", filename)
+	info, err := s.backend.Stat(filename)
+	if err == ErrNotFound {
+		return fmt.Errorf("Item %s %w", filename, ErrNotFound)
 	} else if err != nil {
 		return err
 	}
-	name := item.Name()
-	size, err := item.Size()
+	name := info.Name
+	log.Printf("Item %s found [size: %d]\n", name, info.Size)
+	log.Printf("Saving item %s ...", name)
+	cache := s.cacheFor(filename)
+	reader := cache.get(filename, info.ETag)
+	if reader == nil {
+		if reader, err = s.backend.Get(filename); err != nil {
+			return err
+		}
+		reader = cache.fill(filename, info.ETag, info.Size, reader)
+	}
+	defer reader.Close()
+	plain, err := s.envelope.open(reader)
 	if err != nil {
-		return err
+		return fmt.Errorf("Cannot read item %s: %w", name, err)
 	}
-	log.Printf("Item %s found [size: %d]\n", name, size)
-	log.Printf("Saving item %s ...", name)
-	reader, err := item.Open()
+	content, err := decompress(info.Metadata[MetadataCompression], plain)
 	if err != nil {
-		return err
+		return fmt.Errorf("Cannot decompress item %s: %v", name, err)
 	}
-	defer reader.Close()
-	_, err = io.Copy(obj, reader)
+	defer content.Close()
+	_, err = io.Copy(obj, content)
 	if err != nil {
 		return err
 	}
@@ -159,25 +159,23 @@ func (s *Data) Download(filename string, obj io.WriteCloser) error {
 
 // Exists is the single interface to check for file existence from Object Storage
 func (s *Data) Exists(filename string) bool {
-	_, err := s.container.Item(filename)
+	_, err := s.backend.Stat(filename)
 	return err == nil
 }
 
 // List is the single interface to List a file in a specified directory
 func (s *Data) List(dir string) ([]string, error) {
-	var files []string
-	err := stow.Walk(s.container, dir, 100,
-		func(item stow.Item, err error) error {
-			if err != nil {
-				return err
-			}
-			file := strings.Replace(item.Name(), dir, "", -1)
-			files = append(files, file)
-			return nil
-		})
+	names, err := s.backend.List(dir)
 	if err != nil {
 		return []string{""}, err
 	}
+	var files []string
+	for _, name := range names {
+		if isManifest(name) || isLock(name) {
+			continue
+		}
+		files = append(files, strings.Replace(name, dir, "", -1))
+	}
 	return files, nil
 }
 
@@ -185,37 +183,80 @@ func (s *Data) List(dir string) ([]string, error) {
 func (s *Data) Upload(filename string, size int64, obj io.ReadCloser) error {
 	//upload snapshot to container with given name
 	defer obj.Close()
-	if _, err := s.container.Item(filename); err == nil {
-		log.Fatalf("%s exists already", filename)
-	}
-	item, err := s.container.Put(filename, obj, size, nil)
-	if err != nil {
-		return err
-	}
-	log.Println("Item URL: ", item.URL())
-	if err != nil {
-		return err
+	if s.Exists(filename) {
+		return fmt.Errorf("%s %w", filename, ErrAlreadyExists)
 	}
-	return nil
+	return s.put(filename, obj, size)
 }
 
 func (s *Data) UploadForce(filename string, size int64, obj io.ReadCloser) error {
 	//upload snapshot to container with given name
 	defer obj.Close()
-	item, err := s.container.Put(filename, obj, size, nil)
-	if err != nil {
-		return err
+	return s.put(filename, obj, size)
+}
+
+// put writes obj to the backend, sealing it first when encryption is configured.
+// The replaced generation of a versioned object is archived in the history and
+// the digest of the new content is recorded in the manifest of its directory.
+func (s *Data) put(filename string, obj io.Reader, size int64) error {
+	return s.write(filename, obj, size, "overwrite")
+}
+
+// write implements put, recording operation in the history entry of the replaced object
+func (s *Data) write(filename string, obj io.Reader, size int64, operation string) error {
+	return planner.Do(fmt.Sprintf("upload %s (%d bytes)", filename, size), func() error {
+		if err := s.archive(filename, operation); err != nil {
+			return err
+		}
+		return s.writeWith(filename, obj, size, s.backend.Put)
+	})
+}
+
+// writeWith compresses, encrypts and records in the manifest an object stored by put
+func (s *Data) writeWith(filename string, obj io.Reader, size int64, put func(name string, r io.Reader, size int64, metadata map[string]string) error) error {
+	digest := newDigester()
+	obj = io.TeeReader(obj, digest)
+	var extra map[string]string
+	if s.compressor.applies(size) {
+		compressed, compressedSize, cleanup, err := s.compressor.compress(obj, size)
+		if err != nil {
+			return fmt.Errorf("Cannot compress item %s: %v", filename, err)
+		}
+		defer cleanup()
+		obj, size = compressed, compressedSize
+		extra = map[string]string{MetadataCompression: s.compressor.algorithm}
 	}
-	log.Println("Item URL: ", item.URL())
-	if err != nil {
+	metadata := s.metadata(extra)
+	if s.envelope != nil {
+		sealed, sealedSize, err := s.envelope.seal(obj, size)
+		if err != nil {
+			return fmt.Errorf("Cannot encrypt item %s: %v", filename, err)
+		}
+		obj, size = sealed, sealedSize
+	}
+	if err := put(filename, obj, size, metadata); err != nil {
 		return err
 	}
-	return nil
+	if isManifest(filename) {
+		return nil
+	}
+	return s.updateManifest(filename, digest.entry())
 }
 
-// Remove removes the filename with the given path
+// Remove removes the filename with the given path, archiving it first if versioned
 func (s *Data) Remove(filename string) error {
-	return s.container.RemoveItem(filename)
+	return planner.Do("remove "+filename, func() error {
+		if err := s.archive(filename, "remove"); err != nil {
+			return err
+		}
+		if err := s.backend.Delete(filename); err != nil {
+			return err
+		}
+		if isManifest(filename) {
+			return nil
+		}
+		return s.updateManifest(filename, nil)
+	})
 }
 
 // Move moves the file from its current location to the given path
@@ -261,45 +302,72 @@ func (s *Data) UploadFileForce(filename, localPath string) error {
 	return s.UploadForce(filename, fileSize, r)
 }
 
+// UploadFilesFromDirectory uploads the files in parallel, failing for the ones already in the bucket
 func (store *Data) UploadFilesFromDirectory(files [][]string, localDir string, toPath string) error {
-	for _, fileSrcDest := range files {
-		local, remote := filepath.Join(localDir, fileSrcDest[0]), filepath.Join(toPath, fileSrcDest[1])
-		log.Printf("trying to upload %s to %s", local, remote)
-		err := store.UploadFile(remote, local)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return store.uploadFilesFromDirectory(files, localDir, toPath, store.UploadFile)
 }
 
+// UploadFilesFromDirectoryWithForce uploads the files in parallel, replacing the ones already in the bucket
 func (store *Data) UploadFilesFromDirectoryWithForce(files [][]string, localDir string, toPath string) error {
+	return store.uploadFilesFromDirectory(files, localDir, toPath, store.UploadFileForce)
+}
+
+func (store *Data) uploadFilesFromDirectory(files [][]string, localDir string, toPath string, upload func(filename, localPath string) error) error {
+	locals := map[string]string{}
+	var remotes []string
 	for _, fileSrcDest := range files {
 		local, remote := filepath.Join(localDir, fileSrcDest[0]), filepath.Join(toPath, fileSrcDest[1])
-		log.Printf("trying to upload %s to %s", local, remote)
-		err := store.UploadFileForce(remote, local)
-		if err != nil {
-			return err
-		}
+		locals[remote] = local
+		remotes = append(remotes, remote)
 	}
-	return nil
+	return store.batch(remotes, func(remote string) error {
+		log.Printf("trying to upload %s to %s", locals[remote], remote)
+		return upload(remote, locals[remote])
+	})
 }
 
+// UploadFilesFromMemory uploads the files to dir in parallel. Nothing is uploaded if any of them is already in the bucket.
 func (store *Data) UploadFilesFromMemory(files map[string][]byte, dir string) error {
+	contents := map[string][]byte{}
+	var paths []string
 	for filename, file := range files {
 		path := filepath.Join(dir, filename)
-		if _, err := store.container.Item(path); err == nil {
-			log.Fatalf("%s exists already", path)
-		}
-		if _, err := store.container.Put(path, ioutil.NopCloser(bytes.NewReader(file)), int64(len(file)), nil); err != nil {
-			log.Fatal(err)
+		contents[path] = file
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	err := store.batch(paths, func(path string) error {
+		if store.Exists(path) {
+			// the BatchError already names the file
+			return ErrAlreadyExists
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return nil
+	return store.batch(paths, func(path string) error {
+		file := contents[path]
+		if err := store.put(path, bytes.NewReader(file), int64(len(file))); err != nil {
+			return fmt.Errorf("Cannot upload %s: %w", path, err)
+		}
+		return nil
+	})
 }
 
+// DownloadFilesToDirectory downloads the files in localDir. Every file is checked
+// against the manifest of fromPath before replacing the local one.
 func (store *Data) DownloadFilesToDirectory(files [][]string, localDir string, fromPath string, overwrite bool) error {
-	os.MkdirAll(localDir, 0750)
+	err := planner.Do("create directory "+localDir, func() error {
+		return os.MkdirAll(localDir, 0750)
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot create %s: %w", localDir, err)
+	}
+	manifest, err := store.Manifest(fromPath)
+	if err != nil {
+		return err
+	}
 	for _, fileSrcDst := range files {
 		local, remote := fileSrcDst[0], fileSrcDst[1]
 		// if local file name is not set, keep the original name
@@ -307,39 +375,62 @@ func (store *Data) DownloadFilesToDirectory(files [][]string, localDir string, f
 			local = remote
 		}
 		file := filepath.Join(localDir, local)
-		if overwrite {
-			os.Remove(file)
-		} else if _, err := os.Stat(file); !os.IsNotExist(err) {
-			log.Fatalf("file %s already exists, use --overwrite=true", file)
-		}
-		newFile, err := os.Create(file)
-		if err != nil {
-			return err
+		if !overwrite {
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				return fmt.Errorf("file %s %w, use --overwrite=true", file, ErrAlreadyExists)
+			}
 		}
 		bucketPath := filepath.Join(fromPath, remote)
-		err = store.Download(bucketPath, newFile)
+		err := planner.Do(fmt.Sprintf("download %s to %s", bucketPath, file), func() error {
+			return store.downloadVerified(bucketPath, file, manifest)
+		})
 		if err != nil {
-			log.Printf("no %s found in bucket", bucketPath)
 			return err
 		}
 	}
 	return nil
 }
 
+// downloadVerified downloads bucketPath next to file and renames it in place only if its digest matches the manifest
+func (store *Data) downloadVerified(bucketPath, file string, manifest *Manifest) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	digest := newDigester()
+	err = store.Download(bucketPath, teeWriteCloser{io.MultiWriter(tmpFile, digest), tmpFile})
+	tmpFile.Close()
+	if err != nil {
+		log.Printf("no %s found in bucket", bucketPath)
+		return err
+	}
+	if err := store.verify(manifest, bucketPath, digest.sum(), digest.size); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), file)
+}
+
+// DownloadFilesToMemory downloads the files in parallel and returns their content by name,
+// nil if any of them cannot be downloaded
 func (store *Data) DownloadFilesToMemory(files []string, fromPath string) (map[string][]byte, error) {
+	var mu sync.Mutex
 	out := make(map[string][]byte)
-	for _, fn := range files {
+	err := store.batch(files, func(fn string) error {
 		bwc := bufferWriteCloser{new(bytes.Buffer)}
-		err := store.Download(filepath.Join(fromPath, fn), bwc)
-		if err != nil {
-			return nil, err
-		}
-		fileContent := make([]byte, bwc.Buf.Len())
-		_, err = bwc.Buf.Read(fileContent)
-		if err != nil {
-			return nil, err
+		if err := store.Download(filepath.Join(fromPath, fn), bwc); err != nil {
+			return err
 		}
-		out[fn] = fileContent
+		mu.Lock()
+		out[fn] = bwc.Buf.Bytes()
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return out, nil
 }
@@ -0,0 +1,396 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	az "github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/graymeta/stow"
+	"github.com/graymeta/stow/azure"
+	"github.com/graymeta/stow/google"
+	"github.com/graymeta/stow/local"
+	"google.golang.org/api/googleapi"
+	gstorage "google.golang.org/api/storage/v1"
+)
+
+// metadataSidecarSuffix names the object holding the metadata of another one on the local provider,
+// which does not support metadata
+const metadataSidecarSuffix = ".furyagent-metadata"
+
+// stowBackend implements Backend on top of a stow.Container (azure, google and local providers)
+type stowBackend struct {
+	location      stow.Location
+	containerName string
+	container     stow.Container
+	sidecar       bool
+	// azure and google are the clients of the providers, used for the conditional writes stow does not offer
+	azure  *az.BlobStorageClient
+	google *gstorage.Service
+}
+
+func newStowBackend(cfg *Config) (*stowBackend, error) {
+	s := new(stowBackend)
+
+	config := stow.ConfigMap{}
+	switch cfg.Provider {
+	case "azure":
+		s.containerName = cfg.BucketName
+		account := cfg.AzureStorageAccount
+		if account == "" {
+			account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+		}
+		if account == "" {
+			return nil, errors.New("azure_storage_account or AZURE_STORAGE_ACCOUNT must be set")
+		}
+		key, err := azureStorageKey(cfg, account)
+		if err != nil {
+			return nil, err
+		}
+		config = stow.ConfigMap{
+			azure.ConfigAccount: account,
+			azure.ConfigKey:     key,
+		}
+		client, err := az.NewBasicClient(account, key)
+		if err != nil {
+			return nil, err
+		}
+		blobs := client.GetBlobService()
+		s.azure = &blobs
+	case "google":
+		s.containerName = cfg.BucketName
+		sa, err := googleCredentialsJSON(cfg)
+		if err != nil {
+			return nil, err
+		}
+		config = stow.ConfigMap{
+			google.ConfigJSON:      sa,
+			google.ConfigProjectId: cfg.GoogleProjectId,
+		}
+	case "local":
+		config = stow.ConfigMap{
+			local.ConfigKeyPath: cfg.LocalPath,
+		}
+		s.containerName = cfg.LocalPath
+		s.sidecar = true
+	default:
+		return nil, fmt.Errorf("provider \"%s\" not supported", cfg.Provider)
+	}
+	location, err := stow.Dial(cfg.Provider, config)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot dial to %s: %w", cfg.Provider, err)
+	}
+	s.location = location
+	if l, ok := location.(*google.Location); ok {
+		s.google = l.Service()
+	}
+	container, err := s.getContainer()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get container %s: %w", s.containerName, err)
+	}
+	s.container = container
+	return s, nil
+}
+
+// stowError maps the errors of the azure, google and local providers to the errors of the Backend interface
+func stowError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// stow wraps the errors of the providers with github.com/pkg/errors
+	cause := err
+	for {
+		if c, ok := cause.(interface{ Cause() error }); ok && c.Cause() != nil {
+			cause = c.Cause()
+			continue
+		}
+		break
+	}
+	forbidden := os.IsPermission(cause)
+	var azErr az.AzureStorageServiceError
+	if errors.As(cause, &azErr) && azErr.StatusCode == http.StatusForbidden {
+		forbidden = true
+	}
+	var gErr *googleapi.Error
+	if errors.As(cause, &gErr) && gErr.Code == http.StatusForbidden {
+		forbidden = true
+	}
+	if forbidden {
+		return fmt.Errorf("%w: %v", ErrPermission, err)
+	}
+	return err
+}
+
+func (s *stowBackend) getContainer() (stow.Container, error) {
+	container, err := s.location.Container(s.containerName)
+	if err == stow.ErrNotFound {
+		log.Println("Container not found, trying to create one!")
+		container, err = s.location.CreateContainer(s.containerName)
+		if err != nil {
+			return nil, stowError(err)
+		}
+	} else if err != nil {
+		log.Println("Generic error accessing the container: ", s.containerName)
+		return nil, stowError(err)
+	}
+
+	return container, nil
+}
+
+func (s *stowBackend) item(name string) (stow.Item, error) {
+	item, err := s.container.Item(name)
+	// the local provider finds directories too, they are not objects
+	if err == stow.ErrNotFound || (err != nil && err.Error() == "unexpected directory") {
+		return nil, ErrNotFound
+	}
+	return item, stowError(err)
+}
+
+// Get implements Backend
+func (s *stowBackend) Get(name string) (io.ReadCloser, error) {
+	item, err := s.item(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := item.Open()
+	return r, stowError(err)
+}
+
+// Put implements Backend
+func (s *stowBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	var md map[string]interface{}
+	if len(metadata) > 0 {
+		md = make(map[string]interface{}, len(metadata))
+		for k, v := range metadata {
+			md[k] = v
+		}
+	}
+	if s.sidecar {
+		md = nil
+	}
+	item, err := s.container.Put(name, r, size, md)
+	if err != nil {
+		return stowError(err)
+	}
+	log.Println("Item URL: ", item.URL())
+	if s.sidecar {
+		return s.putSidecar(name, metadata)
+	}
+	return nil
+}
+
+// PutIfMatch implements ConditionalBackend with the If-Match of azure and the ifGenerationMatch
+// of google. The local provider, without conditional writes, holds the lease of a lock object.
+func (s *stowBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	switch {
+	case s.azure != nil:
+		return s.azurePutIfMatch(name, r, metadata, etag)
+	case s.google != nil:
+		return s.googlePutIfMatch(name, r, metadata, etag)
+	default:
+		return putWithLease(s, name, r, size, metadata, etag)
+	}
+}
+
+func (s *stowBackend) azurePutIfMatch(name string, r io.Reader, metadata map[string]string, etag string) error {
+	blob := s.azure.GetContainerReference(s.containerName).GetBlobReference(name)
+	blob.Metadata = az.BlobMetadata(metadata)
+	options := &az.PutBlobOptions{}
+	if etag == "" {
+		options.IfNoneMatch = "*"
+	} else {
+		// stow strips the quotes of the azure ETags
+		options.IfMatch = `"` + etag + `"`
+	}
+	err := blob.CreateBlockBlobFromReader(r, options)
+	var azErr az.AzureStorageServiceError
+	if errors.As(err, &azErr) && (azErr.StatusCode == http.StatusPreconditionFailed || azErr.StatusCode == http.StatusConflict) {
+		return ErrConflict
+	}
+	return stowError(err)
+}
+
+func (s *stowBackend) googlePutIfMatch(name string, r io.Reader, metadata map[string]string, etag string) error {
+	// the generation changes with every write, 0 means that the object must not exist
+	var generation int64
+	if etag != "" {
+		current, err := s.google.Objects.Get(s.containerName, name).Do()
+		var gErr *googleapi.Error
+		if errors.As(err, &gErr) && gErr.Code == http.StatusNotFound {
+			return ErrConflict
+		} else if err != nil {
+			return stowError(err)
+		}
+		if current.Etag != etag {
+			return ErrConflict
+		}
+		generation = current.Generation
+	}
+	object := &gstorage.Object{Name: name, Metadata: metadata}
+	_, err := s.google.Objects.Insert(s.containerName, object).IfGenerationMatch(generation).Media(r).Do()
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusPreconditionFailed {
+		return ErrConflict
+	}
+	return stowError(err)
+}
+
+// createExclusive implements exclusiveCreator for the local provider
+func (s *stowBackend) createExclusive(name string, content []byte) error {
+	if s.azure != nil || s.google != nil {
+		return errors.New("exclusive creation is only implemented for the local provider")
+	}
+	path := filepath.Join(s.container.ID(), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ErrAlreadyExists
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// putSidecar stores the metadata of name next to it, or removes the old ones
+func (s *stowBackend) putSidecar(name string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		if item, err := s.item(name + metadataSidecarSuffix); err == nil {
+			return s.container.RemoveItem(item.ID())
+		}
+		return nil
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	_, err = s.container.Put(name+metadataSidecarSuffix, bytes.NewReader(content), int64(len(content)), nil)
+	return err
+}
+
+func (s *stowBackend) readSidecar(name string) (map[string]string, error) {
+	item, err := s.item(name + metadataSidecarSuffix)
+	if err == ErrNotFound {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r, err := item.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	metadata := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %v", name, err)
+	}
+	return metadata, nil
+}
+
+// List implements Backend
+func (s *stowBackend) List(prefix string) ([]string, error) {
+	var names []string
+	err := stow.Walk(s.container, prefix, 100,
+		func(item stow.Item, err error) error {
+			if err != nil {
+				return err
+			}
+			if s.sidecar && strings.HasSuffix(item.Name(), metadataSidecarSuffix) {
+				return nil
+			}
+			names = append(names, item.Name())
+			return nil
+		})
+	if err != nil {
+		return nil, stowError(err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements Backend
+func (s *stowBackend) Delete(name string) error {
+	// the local provider wants the item ID (its absolute path), not its name
+	item, err := s.item(name)
+	if err != nil {
+		return err
+	}
+	if err := s.container.RemoveItem(item.ID()); err != nil {
+		return stowError(err)
+	}
+	if s.sidecar {
+		return s.putSidecar(name, nil)
+	}
+	return nil
+}
+
+// Stat implements Backend
+func (s *stowBackend) Stat(name string) (*ObjectInfo, error) {
+	item, err := s.item(name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := item.Size()
+	if err != nil {
+		return nil, err
+	}
+	etag, err := item.ETag()
+	if err != nil {
+		return nil, err
+	}
+	lastMod, err := item.LastMod()
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	if s.sidecar {
+		if metadata, err = s.readSidecar(name); err != nil {
+			return nil, err
+		}
+	} else if md, err := item.Metadata(); err == nil {
+		for k, v := range md {
+			if value, ok := v.(string); ok {
+				metadata[k] = value
+			}
+		}
+	}
+	return &ObjectInfo{
+		Name:         item.Name(),
+		Size:         size,
+		ETag:         etag,
+		LastModified: lastMod,
+		Metadata:     metadata,
+	}, nil
+}
+
+// Close implements Backend
+func (s *stowBackend) Close() error {
+	return s.location.Close()
+}
@@ -18,6 +18,7 @@ import (
 	"archive/zip"
 	"io"
 	"os"
+	"path/filepath"
 )
 
 // ZipArchive creates a zipfile (this function allows only for absolute paths)
@@ -27,40 +28,52 @@ func ZipArchive(zipname string, files ...string) error {
 		return err
 	}
 	defer newZipFile.Close()
+	return writeZip(newZipFile, "", files...)
+}
 
-	zipWriter := zip.NewWriter(newZipFile)
+// writeZip writes to w a zip archive of the files, named as given and read from root
+func writeZip(w io.Writer, root string, files ...string) error {
+	zipWriter := zip.NewWriter(w)
 	defer zipWriter.Close()
 
 	for _, file := range files {
-		zipfile, err := os.Open(file)
-		if err != nil {
+		if err := addZipFile(zipWriter, root, file); err != nil {
 			return err
 		}
-		defer zipfile.Close()
+	}
+	return zipWriter.Close()
+}
 
-		info, err := zipfile.Stat()
-		if err != nil {
-			return err
-		}
+// addZipFile writes file, read from root, to zipWriter and closes it
+func addZipFile(zipWriter *zip.Writer, root, file string) error {
+	zipfile, err := os.Open(filepath.Join(root, file))
+	if err != nil {
+		return err
+	}
+	defer zipfile.Close()
 
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
-		}
+	info, err := zipfile.Stat()
+	if err != nil {
+		return err
+	}
 
-		header.Name = file
-		header.Method = zip.Deflate
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
 
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return err
-		}
+	header.Name = file
+	header.Method = zip.Deflate
 
-		if _, err = io.Copy(writer, zipfile); err != nil {
-			return err
-		}
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(writer, zipfile); err != nil {
+		return err
 	}
-	return nil
+	return zipfile.Close()
 }
 
 // FileSize is an utility to calculate dimension of file to upload
@@ -0,0 +1,367 @@
+// Copyright © 2018 Sighup SRL support@sighup.io
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultContentKey     = "content"
+	vaultMetadataPrefix = "meta_"
+)
+
+// VaultConfig represent the configuration of the vault provider, which stores
+// every object as a KV v2 secret under <mount>/<path>/<object name>
+type VaultConfig struct {
+	Address      string `mapstructure:"address"`
+	Namespace    string `mapstructure:"namespace"`
+	Mount        string `mapstructure:"mount"`
+	Path         string `mapstructure:"path"`
+	Token        string `mapstructure:"token"`
+	RoleID       string `mapstructure:"roleId"`
+	SecretID     string `mapstructure:"secretId"`
+	AppRoleMount string `mapstructure:"approleMount"`
+}
+
+// vaultBackend implements Backend on top of the Vault KV v2 HTTP API
+type vaultBackend struct {
+	client  *http.Client
+	address string
+	cfg     VaultConfig
+
+	mu    sync.Mutex
+	token string
+}
+
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Auth   *vaultAuth      `json:"auth"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultAuth struct {
+	ClientToken string `json:"client_token"`
+}
+
+type vaultSecret struct {
+	Data     map[string]string `json:"data"`
+	Metadata struct {
+		CreatedTime time.Time `json:"created_time"`
+		Version     int       `json:"version"`
+	} `json:"metadata"`
+}
+
+func newVaultBackend(cfg *Config) (*vaultBackend, error) {
+	v := &vaultBackend{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		address: strings.TrimSuffix(cfg.Vault.Address, "/"),
+		cfg:     cfg.Vault,
+	}
+	if v.address == "" {
+		v.address = strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	}
+	if v.address == "" {
+		return nil, errors.New("vault address is not set, use storage.vault.address or VAULT_ADDR")
+	}
+	if v.cfg.Mount == "" {
+		v.cfg.Mount = "secret"
+	}
+	if v.cfg.AppRoleMount == "" {
+		v.cfg.AppRoleMount = "approle"
+	}
+	if err := v.login(); err != nil {
+		return nil, fmt.Errorf("Cannot authenticate to vault %s: %w", v.address, err)
+	}
+	return v, nil
+}
+
+// login picks the token from the configuration, AppRole or VAULT_TOKEN, in this order
+func (v *vaultBackend) login() error {
+	switch {
+	case v.cfg.Token != "":
+		v.token = v.cfg.Token
+	case v.cfg.RoleID != "":
+		body, _ := json.Marshal(map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID})
+		resp, err := v.request("POST", path.Join("auth", v.cfg.AppRoleMount, "login"), body, "")
+		if err != nil {
+			return err
+		}
+		if resp.Auth == nil || resp.Auth.ClientToken == "" {
+			return errors.New("AppRole login returned no token")
+		}
+		v.token = resp.Auth.ClientToken
+	case os.Getenv("VAULT_TOKEN") != "":
+		v.token = os.Getenv("VAULT_TOKEN")
+	default:
+		return errors.New("no token, AppRole or VAULT_TOKEN configured")
+	}
+	return nil
+}
+
+// do sends the request with the current token. The token of an AppRole login expires,
+// so a denied request logs in again and is retried once
+func (v *vaultBackend) do(method, apiPath string, body []byte) (*vaultResponse, error) {
+	token := v.currentToken()
+	resp, err := v.request(method, apiPath, body, token)
+	if errors.Is(err, ErrPermission) && v.cfg.Token == "" && v.cfg.RoleID != "" {
+		if err := v.relogin(token); err != nil {
+			return nil, fmt.Errorf("Cannot authenticate to vault %s: %w", v.address, err)
+		}
+		resp, err = v.request(method, apiPath, body, v.currentToken())
+	}
+	return resp, err
+}
+
+func (v *vaultBackend) currentToken() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.token
+}
+
+// relogin logs in again, unless a concurrent request already replaced the denied token
+func (v *vaultBackend) relogin(denied string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.token != denied {
+		return nil
+	}
+	return v.login()
+}
+
+func (v *vaultBackend) request(method, apiPath string, body []byte, token string) (*vaultResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, v.address+"/v1/"+apiPath, reader)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("%w: vault denied %s %s", ErrPermission, method, apiPath)
+	}
+	resp := new(vaultResponse)
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, resp); err != nil {
+			return nil, fmt.Errorf("invalid vault response (%d): %v", res.StatusCode, err)
+		}
+	}
+	if res.StatusCode == http.StatusBadRequest && strings.Contains(strings.Join(resp.Errors, " "), "check-and-set") {
+		return nil, ErrConflict
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("vault returned %d on %s %s: %s", res.StatusCode, method, apiPath, strings.Join(resp.Errors, ", "))
+	}
+	return resp, nil
+}
+
+func (v *vaultBackend) secretPath(kind, name string) string {
+	return path.Join(v.cfg.Mount, kind, v.cfg.Path, name)
+}
+
+func (v *vaultBackend) read(name string) (*vaultSecret, []byte, error) {
+	resp, err := v.do("GET", v.secretPath("data", name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := new(vaultSecret)
+	if err := json.Unmarshal(resp.Data, secret); err != nil {
+		return nil, nil, fmt.Errorf("invalid vault secret %s: %v", name, err)
+	}
+	encoded, ok := secret.Data[vaultContentKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("vault secret %s was not written by furyagent", name)
+	}
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid vault secret %s: %v", name, err)
+	}
+	return secret, content, nil
+}
+
+// Get implements Backend
+func (v *vaultBackend) Get(name string) (io.ReadCloser, error) {
+	_, content, err := v.read(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+// Put implements Backend
+func (v *vaultBackend) Put(name string, r io.Reader, size int64, metadata map[string]string) error {
+	return v.put(name, r, size, metadata, nil)
+}
+
+// PutIfMatch implements ConditionalBackend with the KV v2 check-and-set option,
+// the ETag of a secret is its version and version 0 means that it does not exist
+func (v *vaultBackend) PutIfMatch(name string, r io.Reader, size int64, metadata map[string]string, etag string) error {
+	version := 0
+	if etag != "" {
+		var err error
+		if version, err = strconv.Atoi(etag); err != nil {
+			return fmt.Errorf("invalid version %s for vault secret %s", etag, name)
+		}
+	}
+	return v.put(name, r, size, metadata, map[string]interface{}{"cas": version})
+}
+
+func (v *vaultBackend) put(name string, r io.Reader, size int64, metadata map[string]string, options map[string]interface{}) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) != size {
+		return fmt.Errorf("bad size for %s: expected %d bytes, got %d", name, size, len(content))
+	}
+	data := map[string]string{vaultContentKey: base64.StdEncoding.EncodeToString(content)}
+	for k, val := range metadata {
+		data[vaultMetadataPrefix+k] = val
+	}
+	request := map[string]interface{}{"data": data}
+	if options != nil {
+		request["options"] = options
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	_, err = v.do("POST", v.secretPath("data", name), body)
+	return err
+}
+
+// listDir returns recursively the secrets below dir (which is empty or ends with a slash)
+func (v *vaultBackend) listDir(dir string) ([]string, error) {
+	resp, err := v.do("LIST", v.secretPath("metadata", dir), nil)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Data, &list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range list.Keys {
+		if strings.HasSuffix(key, "/") {
+			children, err := v.listDir(dir + key)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, children...)
+		} else {
+			names = append(names, dir+key)
+		}
+	}
+	return names, nil
+}
+
+// List implements Backend
+func (v *vaultBackend) List(prefix string) ([]string, error) {
+	// vault lists directories, start from the one containing prefix and filter
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(prefix) + "/"
+		if dir == "./" {
+			dir = ""
+		}
+	}
+	all, err := v.listDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete implements Backend, every version of the secret is destroyed
+func (v *vaultBackend) Delete(name string) error {
+	if _, err := v.Stat(name); err != nil {
+		return err
+	}
+	_, err := v.do("DELETE", v.secretPath("metadata", name), nil)
+	return err
+}
+
+// Stat implements Backend
+func (v *vaultBackend) Stat(name string) (*ObjectInfo, error) {
+	secret, content, err := v.read(name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	for k, val := range secret.Data {
+		if strings.HasPrefix(k, vaultMetadataPrefix) {
+			metadata[strings.TrimPrefix(k, vaultMetadataPrefix)] = val
+		}
+	}
+	return &ObjectInfo{
+		Name:         name,
+		Size:         int64(len(content)),
+		ETag:         strconv.Itoa(secret.Metadata.Version),
+		LastModified: secret.Metadata.CreatedTime,
+		Metadata:     metadata,
+	}, nil
+}
+
+// Close implements Backend
+func (v *vaultBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault implements the subset of the KV v2 and AppRole APIs used by vaultBackend
+type fakeVault struct {
+	mu       sync.Mutex
+	secrets  map[string]map[string]string
+	versions map[string]int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["role_id"] != "role" || login["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": "approle-token"}})
+		return
+	}
+	if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "approle-token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		switch r.Method {
+		case "GET":
+			data, ok := f.secrets[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     data,
+					"metadata": map[string]interface{}{"version": f.versions[name], "created_time": "2020-01-01T00:00:00Z"},
+				},
+			})
+		case "POST", "PUT":
+			var body struct {
+				Data    map[string]string `json:"data"`
+				Options struct {
+					CAS *int `json:"cas"`
+				} `json:"options"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Options.CAS != nil && *body.Options.CAS != f.versions[name] {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+				return
+			}
+			f.versions[name]++
+			f.secrets[name] = body.Data
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		switch r.Method {
+		case "DELETE":
+			delete(f.secrets, name)
+			w.WriteHeader(http.StatusNoContent)
+		case "LIST":
+			dir := strings.TrimSuffix(name, "/") + "/"
+			keys := map[string]bool{}
+			for secret := range f.secrets {
+				if strings.HasPrefix(secret, dir) {
+					rest := strings.TrimPrefix(secret, dir)
+					if i := strings.Index(rest, "/"); i >= 0 {
+						rest = rest[:i+1]
+					}
+					keys[rest] = true
+				}
+			}
+			if len(keys) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var list []string
+			for k := range keys {
+				list = append(list, k)
+			}
+			sort.Strings(list)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": list}})
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultBackend(t *testing.T) {
+	vault := &fakeVault{secrets: map[string]map[string]string{}, versions: map[string]int{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	for _, auth := range []VaultConfig{
+		{Address: server.URL, Path: "clusters/test", Token: "root"},
+		{Address: server.URL, Path: "clusters/test", RoleID: "role", SecretID: "secret"},
+	} {
+		store, err := Init(&Config{Provider: "vault", Vault: auth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{
+			"alice.crt": []byte("alice"),
+			"bob.crt":   []byte("bob"),
+		}
+		if err := store.UploadFilesFromMemory(files, "pki/vpn-client"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := vault.secrets["clusters/test/pki/vpn-client/alice.crt"]; !ok {
+			t.Fatalf("secret not stored under the configured path: %v", vault.secrets)
+		}
+		if err := store.Move("bob.crt", "pki/vpn-client", "pki/vpn-client/revoked"); err != nil {
+			t.Fatal(err)
+		}
+		listed, err := store.List("pki/vpn-client")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 2 || listed[0] != "/alice.crt" || listed[1] != "/revoked/bob.crt" {
+			t.Fatalf("unexpected listing: %v", listed)
+		}
+		downloaded, err := store.DownloadFilesToMemory(listed, "pki/vpn-client")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(downloaded["/revoked/bob.crt"]) != "bob" {
+			t.Fatalf("unexpected content: %q", downloaded["/revoked/bob.crt"])
+		}
+		vault.secrets = map[string]map[string]string{}
+		vault.versions = map[string]int{}
+	}
+
+	backend, err := newVaultBackend(&Config{Vault: VaultConfig{Address: server.URL, Token: "root"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.PutIfMatch("ca.crl", strings.NewReader("v1"), 2, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.PutIfMatch("ca.crl", strings.NewReader("v2"), 2, nil, ""); err != ErrConflict {
+		t.Fatalf("expected a conflict creating an existing secret, got %v", err)
+	}
+	if err := backend.PutIfMatch("ca.crl", strings.NewReader("v2"), 2, nil, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an expired AppRole token is replaced by a new login
+	approle, err := newVaultBackend(&Config{Vault: VaultConfig{Address: server.URL, RoleID: "role", SecretID: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	approle.token = "expired"
+	if _, err := approle.Stat("ca.crl"); err != nil {
+		t.Fatalf("expected a new login after the token expired, got %v", err)
+	}
+	if approle.token != "approle-token" {
+		t.Fatalf("token not replaced: %s", approle.token)
+	}
+	backend.token = "expired"
+	if _, err := backend.Stat("ca.crl"); !errors.Is(err, ErrPermission) {
+		t.Fatalf("expected a static token to stay denied, got %v", err)
+	}
+
+	if _, err := Init(&Config{Provider: "vault", Vault: VaultConfig{Address: server.URL, RoleID: "role", SecretID: "wrong"}}); err == nil {
+		t.Fatal("expected AppRole login to fail")
+	}
+}